@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
 	"tcp.scratch.i/internal/headers"
 	"tcp.scratch.i/internal/response"
@@ -16,7 +17,10 @@ import (
 	request "tcp.scratch.i/internal/tests"
 )
 
-const port = 8080
+const (
+	port            = 8080
+	shutdownTimeout = 10 * time.Second
+)
 
 func toStr(payload []byte) string {
 	out := ""
@@ -26,99 +30,116 @@ func toStr(payload []byte) string {
 	return out
 }
 
-func main() {
-	s, err := server.Serve(port, func(w response.Writer, req *request.Request) {
-		h := response.GetDefaultHeaders(0)
-		body := response.Respond200()
-		status := response.StatusOk
-
-		switch {
-		case req.RequestLine.RequestTarget == "/yourproblem":
-			body = response.Respond400()
-			status = response.StatusBadRequest
+func writeHTML(w *response.Writer, status response.StatusCode, body []byte) {
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html")
 
-		case req.RequestLine.RequestTarget == "/myproblem":
-			body = response.Respond500()
-			status = response.StatusInternalSeverError
-
-		case req.RequestLine.RequestTarget == "/video":
-			f, _ := os.ReadFile("assets/vim.mp4")
-			h.Replace("Content-Type", "video/mp4")
-			h.Replace("Content-Length", fmt.Sprintf("%d", len(f)))
-
-			w.WriteStatusLine(response.StatusOk)
-			w.WriteHeaders(*h)
-			w.WriteBody(f)
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
 
-		case strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/stream"):
-			requestTarget := req.RequestLine.RequestTarget
+func handleIndex(w *response.Writer, req *request.Request) {
+	writeHTML(w, response.StatusOk, []byte(`<html>
+  <head>
+    <title>200 OK</title>
+  </head>
+  <body>
+    <h1>Success!</h1>
+    <p>Your request was an absolute banger.</p>
+  </body>
+</html>
+`))
+}
 
-			res, err := http.Get("https://httpbin.org/" + requestTarget[len("/httpbin/"):])
-			if err != nil {
-				body = response.Respond500()
-				status = response.StatusInternalSeverError
+func handleYourProblem(w *response.Writer, req *request.Request) error {
+	return server.NewHandlerError(response.StatusBadRequest, "Your request honestly kinda sucked.")
+}
 
-				h.Replace("Content-Length", fmt.Sprintf("%d", len(body)))
-				h.Replace("Content-Type", "text/html")
+func handleMyProblem(w *response.Writer, req *request.Request) error {
+	return server.NewHandlerError(response.StatusInternalServerError, "Okay, you know what? This one is on me.")
+}
 
-				w.WriteStatusLine(status)
-				w.WriteHeaders(*h)
-				w.WriteBody(body)
-				return
-			} else {
-				w.WriteStatusLine(response.StatusOk)
+func handleHTTPBinStream(w *response.Writer, req *request.Request) error {
+	res, err := http.Get("https://httpbin.org/stream/" + req.PathValue("n"))
+	if err != nil {
+		return &server.HandlerError{
+			StatusCode: response.StatusBadGateway,
+			Message:    "httpbin could not be reached.",
+			Err:        err,
+		}
+	}
+	defer res.Body.Close()
 
-				h.Delete("Content-Length")
-				h.Set("transfer-encoding", "chunked")
+	w.WriteStatusLine(response.StatusOk)
 
-				h.Replace("Content-Type", "text/plain")
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("transfer-encoding", "chunked")
 
-				h.Set("Trailer", "X-Content-SHA256")
-				h.Set("Trailer", "X-Content-Length")
+	h.Set("Content-Type", "text/plain")
 
-				w.WriteHeaders(*h)
+	h.Add("Trailer", "X-Content-SHA256")
+	h.Add("Trailer", "X-Content-Length")
 
-				fullbody := []byte{}
-				for {
-					data := make([]byte, 32)
-					n, err := res.Body.Read(data)
-					if err != nil {
-						break
-					}
+	w.WriteHeaders(*h)
 
-					fullbody = append(fullbody, data[:n]...)
-					w.WriteBody(fmt.Appendf(nil, "%x\r\n", n))
-					w.WriteBody(data[:n])
-					w.WriteBody([]byte("\r\n"))
-				}
-				w.WriteBody([]byte("0\r\n"))
+	fullbody := []byte{}
+	data := make([]byte, 32)
+	for {
+		n, err := res.Body.Read(data)
+		if n > 0 {
+			fullbody = append(fullbody, data[:n]...)
+			w.WriteChunkedBody(data[:n])
+		}
 
-				trailers := headers.NewHeaders()
+		if err != nil {
+			break
+		}
+	}
+	w.WriteChunkedBodyDone()
 
-				out := sha256.Sum256(fullbody)
+	trailers := headers.NewHeaders()
 
-				trailers.Set("X-Content-SHA256", toStr(out[:]))
-				trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullbody)))
+	out := sha256.Sum256(fullbody)
 
-				w.WriteHeaders(*trailers)
-				w.WriteBody([]byte("\r\n"))
+	trailers.Set("X-Content-SHA256", toStr(out[:]))
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullbody)))
 
-				return
-			}
+	return w.WriteTrailers(*trailers)
+}
 
-		}
+func main() {
+	metrics := server.NewMetrics()
 
-		h.Replace("Content-Length", fmt.Sprintf("%d", len(body)))
-		h.Replace("Content-Type", "text/html")
+	mux := server.NewServeMux()
+	mux.Handle("GET", "/metrics", metrics.ServeHTTP)
+	mux.Handle("GET", "/{path...}", handleIndex)
+	mux.Handle("GET", "/yourproblem", server.HandleErrors(handleYourProblem, nil, nil))
+	mux.Handle("GET", "/myproblem", server.HandleErrors(handleMyProblem, nil, nil))
 
-		w.WriteStatusLine(status)
-		w.WriteHeaders(*h)
-		w.WriteBody(body)
+	assets := server.FileServer(os.DirFS("assets"))
+	mux.Handle("GET", "/video", func(w *response.Writer, req *request.Request) {
+		assets.ServeFile(w, req, "vim.mp4")
 	})
+	mux.Handle("GET", "/assets/{path...}", server.StripPrefix("/assets", assets.ServeHTTP, nil))
+	mux.Handle("GET", "/httpbin/stream/{n}", server.HandleErrors(handleHTTPBinStream, nil, nil))
+
+	handler := server.Chain(mux.ServeHTTP,
+		server.RequestID(),
+		server.AccessLog(nil),
+		server.Compress(server.DefaultCompressMinSize),
+		server.DecodeBody(10<<20, nil),
+		server.Recover(nil, nil),
+	)
+
+	s, err := server.Serve(port, handler,
+		server.WithTimeouts(10*time.Second, 0, 0, time.Minute),
+		server.WithMetrics(metrics),
+	)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer s.Close()
 
 	log.Println("Server started on port", port)
 
@@ -126,5 +147,14 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("Error while shutting down, closing remaining connections:", err)
+		s.Close()
+		return
+	}
+
 	log.Println("Server gracefully stopped")
 }
@@ -37,8 +37,9 @@ func main() {
 			fmt.Println("key:", k, "value:", v)
 		})
 
+		body, _ := req.BodyBytes()
 		fmt.Println("Body:")
-		fmt.Print(req.Body)
+		fmt.Print(string(body))
 
 		conn.Close()
 	}
@@ -4,12 +4,79 @@ package headers
 import (
 	"bytes"
 	"errors"
-	"fmt"
+	"slices"
 	"strings"
 )
 
+// Headers is an ordered list of field lines. Names keep the casing they were
+// given with but are matched case-insensitively, and a name may appear on
+// several lines, which is how Set-Cookie has to be sent. A plain copy shares
+// its state with the original, use Clone for one that can be changed on its
+// own.
 type Headers struct {
-	headers map[string]string
+	fields []field
+
+	// lines counts the lines of every lower-cased name, it keeps Len cheap
+	lines map[string]int
+
+	nameCase NameCase
+}
+
+// NameCase is how field names are written out. Names are case-insensitive,
+// some clients still expect a given form.
+type NameCase int
+
+const (
+	// CaseDefault leaves the choice to whoever writes the headers, lower
+	// case unless told otherwise.
+	CaseDefault NameCase = iota
+
+	// CaseLower writes "content-length".
+	CaseLower
+
+	// CaseOriginal writes names as they were given to Add and Set or as
+	// they were received.
+	CaseOriginal
+
+	// CaseCanonical writes "Content-Length".
+	CaseCanonical
+)
+
+// Format returns name written in the case c asks for.
+func (c NameCase) Format(name string) string {
+	switch c {
+	case CaseOriginal:
+		return name
+	case CaseCanonical:
+		return CanonicalName(name)
+	default:
+		return strings.ToLower(name)
+	}
+}
+
+// CanonicalName upper-cases the first letter of name and every letter
+// following a hyphen, the rest is lower-cased: "content-length" becomes
+// "Content-Length".
+func CanonicalName(name string) string {
+	b := []byte(name)
+	upper := true
+	for i, c := range b {
+		switch {
+		case upper && 'a' <= c && c <= 'z':
+			b[i] = c - ('a' - 'A')
+		case !upper && 'A' <= c && c <= 'Z':
+			b[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
+
+// field is one field line.
+type field struct {
+	name  string
+	key   string // name lower-cased, for lookups
+	value string
 }
 
 var SEPERATOR = []byte("\r\n")
@@ -40,42 +107,131 @@ func parseHeader(fieldLine []byte) (string, string, error) {
 }
 
 func NewHeaders() *Headers {
-	return &Headers{
-		headers: make(map[string]string),
+	return &Headers{lines: make(map[string]int)}
+}
+
+// Clone returns a copy of h that does not share anything with it.
+func (h *Headers) Clone() *Headers {
+	c := &Headers{
+		fields:   slices.Clone(h.fields),
+		lines:    make(map[string]int, len(h.lines)),
+		nameCase: h.nameCase,
 	}
+	for key, n := range h.lines {
+		c.lines[key] = n
+	}
+	return c
 }
 
+// Map calls cb for every field line in the order they were added, with the
+// lower-cased field name.
 func (h *Headers) Map(cb func(k, v string)) {
-	fmt.Println(h.headers)
+	for _, f := range h.fields {
+		cb(f.key, f.value)
+	}
+}
 
-	for k, v := range h.headers {
-		cb(k, v)
+// Each calls cb for every field line in the order they were added, with the
+// field name as it was given.
+func (h *Headers) Each(cb func(name, value string)) {
+	for _, f := range h.fields {
+		cb(f.name, f.value)
 	}
 }
 
+// SetNameCase picks how the names of h are written out, it overrides the
+// choice of the writer for these headers.
+func (h *Headers) SetNameCase(c NameCase) {
+	h.nameCase = c
+}
+
+// NameCase returns the case set with SetNameCase, CaseDefault if none was.
+func (h *Headers) NameCase() NameCase {
+	return h.nameCase
+}
+
+// Len returns the number of distinct field names.
+func (h *Headers) Len() int {
+	return len(h.lines)
+}
+
+// Get returns the values of every line named name joined with ",", which
+// is how a list-based field reads as one. Use Values for fields that can not
+// be combined, such as Set-Cookie.
 func (h *Headers) Get(name string) (string, bool) {
-	headers, ok := h.headers[strings.ToLower(name)]
-	return headers, ok
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ","), true
 }
 
-func (h *Headers) Replace(name, value string) {
-	h.headers[strings.ToLower(name)] = value
+// Values returns the value of every line named name, in order.
+func (h *Headers) Values(name string) []string {
+	key := strings.ToLower(name)
+
+	var values []string
+	for _, f := range h.fields {
+		if f.key == key {
+			values = append(values, f.value)
+		}
+	}
+	return values
 }
 
-func (h *Headers) Delete(name string) {
-	delete(h.headers, strings.ToLower(name))
+// Add appends a field line, the lines already named name are kept.
+func (h *Headers) Add(name, value string) {
+	if h.lines == nil {
+		h.lines = make(map[string]int)
+	}
+
+	key := strings.ToLower(name)
+	h.fields = append(h.fields, field{name: name, key: key, value: value})
+	h.lines[key]++
 }
 
+// Set makes value the only value of name. It takes the place of the first
+// line named name, or is appended when there is none.
 func (h *Headers) Set(name, value string) {
 	key := strings.ToLower(name)
 
-	exisitingValue, exists := h.Get(key)
-	if exists {
-		h.headers[key] = strings.Join([]string{exisitingValue, value}, ",")
+	i := h.index(key)
+	if i == -1 {
+		h.Add(name, value)
 		return
 	}
 
-	h.headers[key] = value
+	h.fields[i] = field{name: name, key: key, value: value}
+	h.delete(key, i+1)
+	h.lines[key] = 1
+}
+
+// Delete removes every line named name.
+func (h *Headers) Delete(name string) {
+	key := strings.ToLower(name)
+	h.delete(key, 0)
+	delete(h.lines, key)
+}
+
+// delete removes the lines named key from the from-th one on.
+func (h *Headers) delete(key string, from int) {
+	if slices.IndexFunc(h.fields[from:], func(f field) bool { return f.key == key }) == -1 {
+		return
+	}
+
+	fields := make([]field, 0, len(h.fields))
+	for i, f := range h.fields {
+		if i < from || f.key != key {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// index returns the position of the first line named key, -1 if there is
+// none.
+func (h *Headers) index(key string) int {
+	return slices.IndexFunc(h.fields, func(f field) bool { return f.key == key })
 }
 
 func isTokenicallyValidFieldName(fieldName []byte) bool {
@@ -91,7 +247,7 @@ func isTokenicallyValidFieldName(fieldName []byte) bool {
 	return true
 }
 
-func (h Headers) Parse(data []byte) (int, bool, error) {
+func (h *Headers) Parse(data []byte) (int, bool, error) {
 	read := 0
 	done := false
 
@@ -109,13 +265,9 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 
 		name, value, err := parseHeader(data[read : read+idx])
 		if err != nil {
-			if len(h.headers) > 0 {
-				read += idx + len(SEPERATOR)
-				continue
-			}
 			return 0, false, err
 		}
-		h.Set(name, value)
+		h.Add(name, value)
 
 		read += idx + len(SEPERATOR)
 	}
@@ -85,25 +85,29 @@ func TestHeaderParse(t *testing.T) {
 	data = []byte("H©st: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.Error(t, err)
-	require.Empty(t, headers.headers)
+	require.Empty(t, headers.fields)
 	assert.Error(t, err, ErrMalformedFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// Test: A malformed line after a valid one is rejected, not skipped
 	headers = NewHeaders()
 	data = []byte("Host: localhost:42069 \r\n Host:  localhost:3000 \r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.NoError(t, err)
-	require.NotEmpty(t, headers.headers)
-	assert.NoError(t, err)
-	assert.Equal(t, 51, n)
-	assert.True(t, done)
+	assert.ErrorIs(t, err, ErrMalformedFieldName)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	headers = NewHeaders()
+	data = []byte("Host: localhost:42069\r\nTransfer-Encoding : chunked\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	assert.ErrorIs(t, err, ErrMalformedFieldName)
 
 	headers = NewHeaders()
 	data = []byte("  Host: localhost:42069    \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.Error(t, err)
-	require.Empty(t, headers.headers)
+	require.Empty(t, headers.fields)
 	assert.Error(t, err, ErrMalformedFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
@@ -116,3 +120,66 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeaderFieldLines(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("Content-Type", "text/plain")
+	h.Add("set-cookie", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+
+	// Test: Repeated fields keep every line, in order
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT"}, h.Values("SET-COOKIE"))
+	assert.Nil(t, h.Values("Missing"))
+	assert.Equal(t, 2, h.Len())
+
+	var lines []string
+	h.Map(func(k, v string) {
+		lines = append(lines, k+": "+v)
+	})
+	assert.Equal(t, []string{"set-cookie: a=1; Path=/", "content-type: text/plain", "set-cookie: b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT"}, lines)
+
+	// Test: Set replaces every line, taking the place of the first one
+	h.Add("X-Last", "1")
+	h.Set("Set-Cookie", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("Set-Cookie"))
+	assert.Equal(t, []field{
+		{name: "Set-Cookie", key: "set-cookie", value: "c=3"},
+		{name: "Content-Type", key: "content-type", value: "text/plain"},
+		{name: "X-Last", key: "x-last", value: "1"},
+	}, h.fields)
+
+	// Test: Delete drops every line and leaves clones alone
+	h.Add("Set-Cookie", "d=4")
+	copied := h.Clone()
+	h.Delete("set-cookie")
+	_, ok := h.Get("Set-Cookie")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"c=3", "d=4"}, copied.Values("Set-Cookie"))
+	assert.Equal(t, 2, h.Len())
+	assert.Equal(t, 3, copied.Len())
+
+	// Test: Parsed fields keep their original names
+	h = NewHeaders()
+	_, _, err := h.Parse([]byte("X-Custom-Header: 1\r\nAccept: a\r\nACCEPT: b\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "X-Custom-Header", h.fields[0].name)
+	assert.Equal(t, []string{"a", "b"}, h.Values("accept"))
+}
+
+func TestNameCase(t *testing.T) {
+	for name, canonical := range map[string]string{
+		"content-length":   "Content-Length",
+		"X-REQUEST-ID":     "X-Request-Id",
+		"www-authenticate": "Www-Authenticate",
+		"etag":             "Etag",
+		"x--y":             "X--Y",
+		"a_b":              "A_b",
+	} {
+		assert.Equal(t, canonical, CanonicalName(name))
+	}
+
+	assert.Equal(t, "content-length", CaseDefault.Format("Content-Length"))
+	assert.Equal(t, "content-length", CaseLower.Format("Content-Length"))
+	assert.Equal(t, "content-LENGTH", CaseOriginal.Format("content-LENGTH"))
+	assert.Equal(t, "Content-Length", CaseCanonical.Format("content-LENGTH"))
+}
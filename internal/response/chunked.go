@@ -0,0 +1,163 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"tcp.scratch.i/internal/headers"
+)
+
+var ErrUndeclaredTrailer = errors.New("trailer field was not declared in the Trailer header")
+
+// WriteChunkedBody writes p as a single chunk of a body sent with
+// "Transfer-Encoding: chunked". Empty writes are skipped since a zero sized
+// chunk marks the end of the body.
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeChunkedBody(p)
+}
+
+func (w *Writer) writeChunkedBody(p []byte) (int, error) {
+	if w.state == StateBody && !w.bodyAllowed() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+
+	if err := w.checkChunkedBody(); err != nil {
+		return 0, err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if w.encoder != nil {
+		n, err := w.encoder.Write(p)
+		if err == nil {
+			err = w.encoder.Flush()
+		}
+		if err != nil {
+			w.keepAlive = false
+		}
+		return n, err
+	}
+
+	return w.writeChunk(p)
+}
+
+// writeChunk frames p as one chunk.
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	chunk := make([]byte, 0, len(p)+16)
+	chunk = fmt.Appendf(chunk, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+
+	if err := w.writeBodyPart(chunk); err != nil {
+		return 0, err
+	}
+	w.bodyWritten += len(p)
+
+	return len(p), nil
+}
+
+// WriteChunkedBodyDone writes the last chunk. When the headers declared
+// trailers the message stays open for WriteTrailers, otherwise it is
+// finished here.
+func (w *Writer) WriteChunkedBodyDone() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeChunkedBodyDone()
+}
+
+func (w *Writer) writeChunkedBodyDone() error {
+	if err := w.checkChunkedBody(); err != nil {
+		return err
+	}
+
+	if err := w.closeEncoder(); err != nil {
+		w.keepAlive = false
+		return err
+	}
+
+	lastChunk := "0\r\n"
+	if len(w.trailers) == 0 {
+		lastChunk += "\r\n"
+		w.state = StateDone
+	} else {
+		w.state = StateTrailers
+	}
+
+	return w.writeBodyPart([]byte(lastChunk))
+}
+
+// WriteTrailers writes the trailer section and finishes the message, the last
+// chunk is written first if WriteChunkedBodyDone was not called. Every field
+// has to be listed in the Trailer header sent with the headers, nothing is
+// written otherwise.
+func (w *Writer) WriteTrailers(h headers.Headers) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch w.state {
+	case StateTrailers:
+	case StateBody:
+		if !w.chunked {
+			return ErrTrailersNotAllowed
+		}
+	case StateDone:
+		return ErrResponseDone
+	default:
+		return ErrTrailersNotAllowed
+	}
+
+	var undeclared []string
+	nameCase := w.nameCaseFor(&h)
+	b := []byte{}
+
+	h.Each(func(name, v string) {
+		if !slices.Contains(w.trailers, strings.ToLower(name)) {
+			undeclared = append(undeclared, name)
+			return
+		}
+		b = fmt.Appendf(b, "%s: %s\r\n", nameCase.Format(name), v)
+	})
+
+	if len(undeclared) > 0 {
+		return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, strings.Join(undeclared, ", "))
+	}
+
+	b = fmt.Append(b, "\r\n")
+
+	if w.state == StateBody {
+		if err := w.closeEncoder(); err != nil {
+			w.keepAlive = false
+			return err
+		}
+		b = append([]byte("0\r\n"), b...)
+	}
+	w.state = StateDone
+
+	return w.writeBodyPart(b)
+}
+
+func (w *Writer) checkChunkedBody() error {
+	switch w.state {
+	case StateBody:
+		if !w.chunked {
+			return ErrBodyNotChunked
+		}
+		return nil
+	case StateTrailers, StateDone:
+		return ErrResponseDone
+	default:
+		return ErrHeadersNotWritten
+	}
+}
@@ -0,0 +1,171 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+)
+
+// Validators describe the current representation of a resource, they are
+// what conditional requests are checked against. Zero fields are unknown.
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// StrongETag returns an entity tag derived from the content itself, it
+// changes whenever a single byte does.
+func StrongETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns an entity tag derived from a modification time and a size,
+// it is cheap but two versions written within the clock's resolution and of
+// the same size are not told apart, hence weak.
+func WeakETag(modTime time.Time, size int64) string {
+	return fmt.Sprintf(`W/"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// EvaluatePreconditions checks the conditional headers of a request made
+// with method against v, in the order of RFC 9110 section 13.2.2. It returns
+// StatusNotModified or StatusPreconditionFailed when the request should be
+// answered with that, zero when it should be served normally. Malformed
+// dates are ignored.
+func EvaluatePreconditions(method string, reqHeaders *headers.Headers, v Validators) StatusCode {
+	safe := method == "GET" || method == "HEAD"
+
+	if ifMatch, ok := reqHeaders.Get("If-Match"); ok {
+		if !matchETag(ifMatch, v.ETag, false) {
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(reqHeaders, "If-Unmodified-Since"); ok && !v.LastModified.IsZero() {
+		if lastModified(v).After(since) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := reqHeaders.Get("If-None-Match"); ok {
+		if matchETag(ifNoneMatch, v.ETag, true) {
+			if safe {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(reqHeaders, "If-Modified-Since"); ok && safe && !v.LastModified.IsZero() {
+		if !lastModified(v).After(since) {
+			return StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// CheckPreconditions is the opt-in for conditional requests. It adds the
+// ETag and Last-Modified of v to the response headers, evaluates the
+// request's preconditions and, when they call for it, writes the whole 304
+// Not Modified or 412 Precondition Failed response. It returns true when the
+// handler should go on and send the representation.
+func (w *Writer) CheckPreconditions(method string, reqHeaders *headers.Headers, v Validators) bool {
+	if v.ETag != "" {
+		w.headers.Set("ETag", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		w.headers.Set("Last-Modified", v.LastModified.UTC().Format(TimeFormat))
+	}
+
+	status := EvaluatePreconditions(method, reqHeaders, v)
+	if status == 0 {
+		return true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writeStatusLine(status); err != nil {
+		return false
+	}
+
+	// a 304 only carries the validators, set above, it has no body to frame
+	h := headers.NewHeaders()
+	if status == StatusPreconditionFailed {
+		h = GetDefaultHeaders(0)
+	}
+	w.writeHeaders(*h)
+
+	return false
+}
+
+func lastModified(v Validators) time.Time {
+	// HTTP dates have a one second resolution
+	return v.LastModified.Truncate(time.Second)
+}
+
+func parseHTTPDate(h *headers.Headers, name string) (time.Time, bool) {
+	value, ok := h.Get(name)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(TimeFormat, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// matchETag reports whether the entity tag list of an If-Match or
+// If-None-Match header contains etag. If-None-Match compares weakly, If-Match
+// strongly, where weak tags never match.
+func matchETag(list, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return etag != ""
+	}
+	if etag == "" {
+		return false
+	}
+
+	etagWeak, etagOpaque := splitETag(etag)
+	if etagWeak && !weak {
+		return false
+	}
+
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+
+		isWeak := strings.HasPrefix(list, "W/")
+		if isWeak {
+			list = list[2:]
+		}
+
+		if !strings.HasPrefix(list, `"`) {
+			return false
+		}
+
+		end := strings.IndexByte(list[1:], '"')
+		if end == -1 {
+			return false
+		}
+
+		opaque := list[:end+2]
+		list = list[end+2:]
+
+		if opaque == etagOpaque && (weak || !isWeak) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitETag(etag string) (bool, string) {
+	if opaque, ok := strings.CutPrefix(etag, "W/"); ok {
+		return true, opaque
+	}
+	return false, etag
+}
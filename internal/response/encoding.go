@@ -0,0 +1,72 @@
+package response
+
+import (
+	"io"
+
+	"tcp.scratch.i/internal/headers"
+)
+
+// Encoder applies a content coding to the body, the encoded bytes go to the
+// writer it was made for. Flush pushes out what it buffered so far and Close
+// ends the coded stream. gzip and zlib writers are Encoders.
+type Encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// EncoderFunc picks the content coding of a response once its status and
+// headers are known. It may edit h, setting Content-Encoding when it returns
+// an Encoder writing to dst, or return nil to send the body as is.
+type EncoderFunc func(status StatusCode, h *headers.Headers, dst io.Writer) Encoder
+
+// SetEncoder installs the function deciding on the content coding, it is
+// called by WriteHeaders for responses that have a body. An encoded body has
+// no known length, Content-Length is dropped in favour of chunked framing.
+// Every body write is flushed through the encoder so streamed responses keep
+// going out as they are written.
+func (w *Writer) SetEncoder(fn EncoderFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.encoderFunc = fn
+}
+
+// chooseEncoder runs the EncoderFunc on the headers about to be sent.
+func (w *Writer) chooseEncoder(h *headers.Headers) {
+	if w.encoderFunc == nil || !w.bodyAllowed() {
+		return
+	}
+
+	enc := w.encoderFunc(w.status, h, chunkWriter{w})
+	if enc == nil {
+		return
+	}
+
+	w.encoder = enc
+	h.Delete("Content-Length")
+	if te, ok := h.Get("Transfer-Encoding"); !ok || !hasToken(te, "chunked") {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+}
+
+// closeEncoder ends the coded stream, its last bytes go out as a chunk.
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+
+	enc := w.encoder
+	w.encoder = nil
+	return enc.Close()
+}
+
+// chunkWriter is where an Encoder writes, every write is one chunk. It is
+// only called with the Writer locked.
+type chunkWriter struct {
+	w *Writer
+}
+
+func (cw chunkWriter) Write(p []byte) (int, error) {
+	return cw.w.writeChunk(p)
+}
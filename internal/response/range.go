@@ -0,0 +1,129 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxRanges bounds the number of ranges served in one response, a request
+// asking for more gets the whole representation.
+const maxRanges = 100
+
+var (
+	ErrInvalidRange        = errors.New("range header is malformed")
+	ErrRangeNotSatisfiable = errors.New("no range overlaps the representation")
+	ErrTooManyRanges       = errors.New("too many ranges")
+)
+
+// ByteRange is a part of a representation, Length bytes starting at Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats r as the value of a Content-Range header for a
+// representation of size bytes.
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// UnsatisfiedRange is the Content-Range value sent with 416 Range Not
+// Satisfiable.
+func UnsatisfiedRange(size int64) string {
+	return fmt.Sprintf("bytes */%d", size)
+}
+
+// ParseRange parses a Range header for a representation of size bytes, see
+// RFC 9110 section 14.2. Ranges reaching past the end are cut to size and
+// ranges starting past it are dropped. It fails with ErrInvalidRange when the
+// header is malformed or not in bytes, which the caller should ignore, with
+// ErrRangeNotSatisfiable when no range is left, and with ErrTooManyRanges
+// when the ranges ask for more than the representation itself.
+func ParseRange(header string, size int64) ([]ByteRange, error) {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, ErrInvalidRange
+	}
+
+	var (
+		ranges []ByteRange
+		total  int64
+	)
+
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r ByteRange
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+
+			n = min(n, size)
+			r = ByteRange{Start: size - n, Length: n}
+		} else {
+			start, err := parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+
+			end := size - 1
+			if last != "" {
+				end, err = parseRangeInt(last)
+				if err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, ErrInvalidRange
+				}
+				end = min(end, size-1)
+			}
+
+			if start >= size {
+				continue
+			}
+			r = ByteRange{Start: start, Length: end - start + 1}
+		}
+
+		ranges = append(ranges, r)
+		total += r.Length
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+
+	if len(ranges) > maxRanges || total > size {
+		return nil, ErrTooManyRanges
+	}
+
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, ErrInvalidRange
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRange
+	}
+	return n, nil
+}
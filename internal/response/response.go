@@ -2,34 +2,54 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 
 	"tcp.scratch.i/internal/headers"
 )
 
-type StatusCode int
+type Response struct {
+	Status StatusCode
+}
+
+// WriterState tracks how far a Writer got into the response, the parts of a
+// response have to go out in this order.
+type WriterState string
 
 const (
-	StatusOk                 StatusCode = 200
-	StatusNotFound           StatusCode = 404
-	StatusNotAuthorized      StatusCode = 401
-	StatusInternalSeverError StatusCode = 500
-	StatusCreated            StatusCode = 201
-	StatusBadRequest         StatusCode = 400
+	StateStatusLine WriterState = "status-line"
+	StateHeaders    WriterState = "headers"
+	StateBody       WriterState = "body"
+	StateTrailers   WriterState = "trailers"
+	StateDone       WriterState = "done"
 )
 
-type Response struct {
-	Status StatusCode
-}
+var (
+	ErrInvalidStatusCode  = errors.New("status code must have three digits")
+	ErrStatusLineWritten  = errors.New("status line already written")
+	ErrHeadersWritten     = errors.New("headers already written")
+	ErrHeadersNotWritten  = errors.New("headers not written yet")
+	ErrBodyNotAllowed     = errors.New("response status does not allow a body")
+	ErrBodyTooLong        = errors.New("body is longer than the Content-Length sent")
+	ErrBodyNotChunked     = errors.New("body is not sent with chunked transfer-encoding")
+	ErrResponseDone       = errors.New("response already finished")
+	ErrTrailersNotAllowed = errors.New("trailers can only follow a chunked body")
+)
+
+// TimeFormat is the HTTP date format, used by Last-Modified and the
+// conditional request headers. Times must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
 // GetDefaultHeaders function set the default headers (until overwitten)
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 
 	h.Set("Content-Length", strconv.Itoa(contentLen))
-	h.Set("Connection", "closed")
 	h.Set("Content-Type", "text/plain")
 
 	return h
@@ -37,94 +57,435 @@ func GetDefaultHeaders(contentLen int) *headers.Headers {
 
 // Writer the part further is writer one where i have the custom writer
 // to give users greater flexiblity of setting and playing with the headers
+//
+// The writer enforces status line, headers, body, trailers ordering, any
+// write out of order fails without touching the connection. It is safe to use
+// from several goroutines.
 type Writer struct {
-	writer io.Writer
+	mu sync.Mutex
+
+	writer    io.Writer
+	state     WriterState
+	status    StatusCode
+	keepAlive bool
+	headers   *headers.Headers
+
+	// head drops the body, the response answers a HEAD request
+	head bool
+
+	// nameCase is how field names are written when the headers do not say
+	nameCase headers.NameCase
+
+	chunked       bool
+	contentLength int
+	bodyWritten   int
+
+	// trailers are the lower-cased field names announced in the Trailer
+	// header, only those may be sent by WriteTrailers
+	trailers []string
+
+	// encoder codes the body when encoderFunc picked a content coding
+	encoderFunc EncoderFunc
+	encoder     Encoder
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		writer: w,
+		writer:        w,
+		state:         StateStatusLine,
+		keepAlive:     true,
+		headers:       headers.NewHeaders(),
+		contentLength: -1,
 	}
 }
 
+// SetKeepAlive tells the writer whether the connection may be reused after
+// this response. When it is false a "Connection: close" header is added on
+// WriteHeaders.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.keepAlive = keepAlive
+}
+
+// SetHead marks the response as the answer to a HEAD request. The headers
+// describe the body a GET would get, Content-Length included, but the body
+// itself is dropped, writes to it succeed without reaching the connection.
+func (w *Writer) SetHead(head bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.head = head
+}
+
+// SetNameCase picks how header and trailer names are written out, lower case
+// by default. Headers that have a NameCase of their own keep it.
+func (w *Writer) SetNameCase(c headers.NameCase) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.nameCase = c
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// this response is done. It turns false when the handler sent
+// "Connection: close" itself, when the body length is only delimited by
+// closing the connection or when the response was cut short.
+func (w *Writer) KeepAlive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.keepAlive
+}
+
+// Headers returns the fields added to the headers sent by WriteHeaders, they
+// let middlewares set response headers without the handler's help. Changes
+// after the headers were written have no effect.
+func (w *Writer) Headers() *headers.Headers {
+	return w.headers
+}
+
+// State returns how far the response got.
+func (w *Writer) State() WriterState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.state
+}
+
+// Written reports whether anything was sent for this response yet.
+func (w *Writer) Written() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.state != StateStatusLine
+}
+
+// Status returns the status code sent, zero until the status line is written.
+func (w *Writer) Status() StatusCode {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes sent, chunk framing excluded.
+func (w *Writer) BytesWritten() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.bodyWritten
+}
+
 // WriteStatusLine is the status line in this case isn't same as request line
 // this is of the format : http-version http-status  status-text
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	statusLine := []byte{}
-
-	switch statusCode {
-	case StatusOk:
-		statusLine = []byte("Http/1.1 200 OK\r\n")
-	case StatusCreated:
-		statusLine = []byte("Http/1.1 201 Created\r\n")
-	case StatusNotAuthorized:
-		statusLine = []byte("Http/1.1 401 Unauthorized\r\n")
-	case StatusInternalSeverError:
-		statusLine = []byte("Http/1.1 500 Internal Sever Error\r\n")
-	case StatusNotFound:
-		statusLine = []byte("Http/1.1 404 Not Found\r\n")
-	case StatusBadRequest:
-		statusLine = []byte("Http/1.1 400 Bad Request\r\n")
-	}
-
-	_, err := w.writer.Write(statusLine)
-	return err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeStatusLine(statusCode)
+}
+
+func (w *Writer) writeStatusLine(statusCode StatusCode) error {
+	if w.state != StateStatusLine {
+		return ErrStatusLineWritten
+	}
+
+	if statusCode < 100 || statusCode > 999 {
+		return ErrInvalidStatusCode
+	}
+
+	statusLine := fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
+
+	w.status = statusCode
+	w.state = StateHeaders
+
+	return w.write(statusLine)
 }
 
+// WriteHeaders sends the header section, writing a 200 status line first if
+// none was written yet. The fields set on Headers are added to h unless h
+// has them already.
 func (w *Writer) WriteHeaders(h headers.Headers) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeHeaders(h)
+}
+
+func (w *Writer) writeHeaders(h headers.Headers) error {
+	// h shares its storage with the caller's headers, which the changes
+	// below must not reach
+	h = *h.Clone()
+
+	switch w.state {
+	case StateStatusLine:
+		if err := w.writeStatusLine(StatusOk); err != nil {
+			return err
+		}
+	case StateHeaders:
+	default:
+		return ErrHeadersWritten
+	}
+
+	// fields of h are checked before the merge so every line of a field
+	// missing from h gets in
+	var missing []string
+	w.headers.Map(func(k, v string) {
+		if _, ok := h.Get(k); !ok {
+			missing = append(missing, k)
+		}
+	})
+	w.headers.Each(func(name, v string) {
+		if slices.Contains(missing, strings.ToLower(name)) {
+			h.Add(name, v)
+		}
+	})
+
+	// 1xx, 204 and 304 responses end with their headers, RFC 9110 section
+	// 8.6 and RFC 9112 section 6.1 forbid framing them
+	if !w.bodyAllowed() {
+		h.Delete("Content-Length")
+		h.Delete("Transfer-Encoding")
+	}
+
+	w.chooseEncoder(&h)
+
+	if connection, ok := h.Get("Connection"); ok && hasToken(connection, "close") {
+		w.keepAlive = false
+	}
+
+	if w.keepAlive && !w.hasFraming(h) {
+		w.keepAlive = false
+	}
+
+	if !w.keepAlive {
+		h.Set("Connection", "close")
+	}
+
+	if te, ok := h.Get("Transfer-Encoding"); ok && hasToken(te, "chunked") {
+		w.chunked = true
+	} else if cl, ok := h.Get("Content-Length"); ok {
+		if n, err := strconv.Atoi(cl); err == nil {
+			w.contentLength = n
+		}
+	}
+
+	if trailer, ok := h.Get("Trailer"); ok {
+		for _, name := range strings.Split(trailer, ",") {
+			w.trailers = append(w.trailers, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+
+	nameCase := w.nameCaseFor(&h)
 	b := []byte{}
-	h.Map(func(k, v string) {
-		b = fmt.Appendf(b, "%s: %s\r\n", k, v)
+	h.Each(func(name, v string) {
+		b = fmt.Appendf(b, "%s: %s\r\n", nameCase.Format(name), v)
 	})
 	b = fmt.Append(b, "\r\n")
 
-	_, err := w.writer.Write(b)
-	return err
+	w.state = StateBody
+
+	return w.write(b)
 }
 
+// WriteBody writes p as (part of) the body. If nothing was written yet a 200
+// status line and chunked default headers go out first. On a chunked response
+// every call is sent as one chunk.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	return w.writer.Write(p)
-}
-
-// status Responses
-func Respond400() []byte {
-	return []byte(`
-		<html>
-		  <head>
-			<title>200 OK</title>
-		  </head>
-		  <body>
-			<h1>Success!</h1>
-			<p>Your request was an absolute banger.</p>
-		  </body>
-		</html>
-	`)
-}
-
-func Respond200() []byte {
-	return []byte(`
-		 <html>
-		  <head>
-			<title>500 Internal Server Error</title>
-		  </head>
-		  <body>
-			<h1>Internal Server Error</h1>
-			<p>Okay, you know what? This one is on me.</p>
-		  </body>
-		</html>
-	`)
-}
-
-func Respond500() []byte {
-	return []byte(`
-		 <html>
-		  <head>
-			<title>500 Internal Server Error</title>
-		  </head>
-		  <body>
-			<h1>Internal Server Error</h1>
-			<p>Okay, you know what? This one is on me.</p>
-		  </body>
-		</html>
-	`)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeBody(p)
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.state == StateHeaders && !w.bodyAllowed() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+
+	switch w.state {
+	case StateStatusLine, StateHeaders:
+		h := GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+
+		if err := w.writeHeaders(*h); err != nil {
+			return 0, err
+		}
+	case StateBody:
+	default:
+		return 0, ErrResponseDone
+	}
+
+	if w.chunked {
+		return w.writeChunkedBody(p)
+	}
+
+	if !w.bodyAllowed() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+
+	if w.contentLength >= 0 && w.bodyWritten+len(p) > w.contentLength {
+		return 0, ErrBodyTooLong
+	}
+
+	if w.head {
+		w.bodyWritten += len(p)
+		return len(p), nil
+	}
+
+	n, err := w.writer.Write(p)
+	w.bodyWritten += n
+	if err != nil {
+		w.keepAlive = false
+	}
+
+	return n, err
+}
+
+// Write is WriteBody, it makes the writer an io.Writer so bodies can be
+// streamed with io.Copy.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+// Finish completes whatever the handler left open: missing headers, the last
+// chunk or the end of the trailer section. A response that was never started
+// is left alone, check Written first. When the body falls short of its
+// Content-Length the connection is marked as not reusable.
+func (w *Writer) Finish() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.finish()
+}
+
+func (w *Writer) finish() error {
+	switch w.state {
+	case StateHeaders:
+		if !w.bodyAllowed() {
+			return w.writeHeaders(*headers.NewHeaders())
+		}
+		return w.writeHeaders(*GetDefaultHeaders(0))
+
+	case StateBody:
+		if w.chunked {
+			return w.writeChunkedBodyDone()
+		}
+
+		if !w.head && w.contentLength >= 0 && w.bodyWritten < w.contentLength {
+			w.keepAlive = false
+		}
+		w.state = StateDone
+
+	case StateTrailers:
+		w.state = StateDone
+		return w.writeBodyPart([]byte("\r\n"))
+	}
+
+	return nil
+}
+
+// Abort gives up on a response that is already on the wire, for instance when
+// the handler fails halfway through the body. Nothing more is written and the
+// connection is closed afterwards so the client sees the response cut short
+// rather than a complete but wrong one.
+func (w *Writer) Abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.abort()
+}
+
+func (w *Writer) abort() {
+	w.state = StateDone
+	w.keepAlive = false
+}
+
+// Interrupt takes the response away from a handler that is still running in
+// another goroutine, every write it attempts afterwards fails. If nothing was
+// sent yet fallback writes the response instead, it gets a writer of its own
+// on the same connection. Otherwise the response is aborted. Either way the
+// connection is not reused since the handler may still be reading the
+// request body.
+func (w *Writer) Interrupt(fallback func(w *Writer)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.state != StateStatusLine {
+		w.abort()
+		return
+	}
+
+	fw := NewWriter(w.writer)
+	fw.SetKeepAlive(false)
+	fw.SetHead(w.head)
+	fw.SetNameCase(w.nameCase)
+	w.headers.Each(func(name, v string) {
+		fw.headers.Add(name, v)
+	})
+
+	fallback(fw)
+	fw.Finish()
+
+	w.status = fw.status
+	w.bodyWritten = fw.bodyWritten
+	w.abort()
+}
+
+// write sends raw protocol bytes, a failed write means the connection can
+// not be trusted anymore.
+func (w *Writer) write(p []byte) error {
+	_, err := w.writer.Write(p)
+	if err != nil {
+		w.keepAlive = false
+	}
+	return err
+}
+
+// writeBodyPart sends body framing, chunks and trailers, which HEAD responses
+// leave out.
+func (w *Writer) writeBodyPart(p []byte) error {
+	if w.head {
+		return nil
+	}
+	return w.write(p)
+}
+
+// nameCaseFor returns the case the names of h are written in.
+func (w *Writer) nameCaseFor(h *headers.Headers) headers.NameCase {
+	if c := h.NameCase(); c != headers.CaseDefault {
+		return c
+	}
+	return w.nameCase
+}
+
+func (w *Writer) bodyAllowed() bool {
+	return w.status != StatusNoContent && w.status != StatusNotModified && (w.status < 100 || w.status >= 200)
+}
+
+// hasFraming reports whether the client can find the end of the body without
+// us closing the connection.
+func (w *Writer) hasFraming(h headers.Headers) bool {
+	if !w.bodyAllowed() {
+		return true
+	}
+
+	if _, ok := h.Get("Content-Length"); ok {
+		return true
+	}
+
+	te, ok := h.Get("Transfer-Encoding")
+	return ok && hasToken(te, "chunked")
+}
+
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,366 @@
+package response
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/headers"
+)
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Chunks, last chunk and declared trailers
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(*h))
+
+	n, err := w.WriteChunkedBody([]byte("hello world!"))
+	require.NoError(t, err)
+	assert.Equal(t, 12, n)
+
+	n, err = w.WriteChunkedBody(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	require.NoError(t, w.WriteChunkedBodyDone())
+
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc123")
+	require.NoError(t, w.WriteTrailers(*trailers))
+
+	assert.True(t, w.KeepAlive())
+	assert.Contains(t, buf.String(), "\r\n\r\nc\r\nhello world!\r\n0\r\nx-checksum: abc123\r\n\r\n")
+
+	// Test: Without trailers the last chunk ends the message
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(*h))
+	require.NoError(t, w.WriteChunkedBodyDone())
+	assert.Contains(t, buf.String(), "\r\n\r\n0\r\n\r\n")
+
+	// Test: Undeclared trailer is refused
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+
+	require.NoError(t, w.WriteHeaders(*h))
+	require.NoError(t, w.WriteChunkedBodyDone())
+
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "nope")
+
+	written := buf.Len()
+	err = w.WriteTrailers(*trailers)
+	assert.ErrorIs(t, err, ErrUndeclaredTrailer)
+	assert.Equal(t, written, buf.Len())
+	assert.Equal(t, StateTrailers, w.State())
+}
+
+func TestWriterOrder(t *testing.T) {
+	// Test: Body first writes an implicit 200 with chunked headers
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.False(t, w.Written())
+
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, w.Written())
+	assert.Equal(t, StateBody, w.State())
+
+	require.NoError(t, w.Finish())
+	assert.Equal(t, StateDone, w.State())
+	assert.True(t, w.KeepAlive())
+
+	out := buf.String()
+	assert.Contains(t, out, "200 OK\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+
+	// Test: Out of order writes are refused and write nothing
+	written := buf.Len()
+	assert.ErrorIs(t, w.WriteStatusLine(StatusOk), ErrStatusLineWritten)
+	assert.ErrorIs(t, w.WriteHeaders(*GetDefaultHeaders(0)), ErrHeadersWritten)
+	_, err = w.WriteBody([]byte("more"))
+	assert.ErrorIs(t, err, ErrResponseDone)
+	assert.Equal(t, written, buf.Len())
+
+	// Test: Status without headers gets default headers on Finish
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusCreated))
+	_, err = w.WriteChunkedBody([]byte("nope"))
+	assert.ErrorIs(t, err, ErrHeadersNotWritten)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "201 Created\r\n")
+	assert.Contains(t, buf.String(), "content-length: 0\r\n")
+
+	// Test: Body must fit the Content-Length and a short body breaks the connection
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(4)))
+	_, err = w.WriteBody([]byte("hello"))
+	assert.ErrorIs(t, err, ErrBodyTooLong)
+	_, err = w.WriteChunkedBody([]byte("hel"))
+	assert.ErrorIs(t, err, ErrBodyNotChunked)
+	_, err = w.WriteBody([]byte("hel"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+
+	// Test: No body for 204
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	h := headers.NewHeaders()
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteBody([]byte("hello"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriteBodyWithoutBodyStatus(t *testing.T) {
+	for _, status := range []StatusCode{StatusNoContent, StatusNotModified} {
+		// Test: A body write after the status line sends no framing and no body
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		require.NoError(t, w.WriteStatusLine(status))
+		_, err := w.WriteBody([]byte("x"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, "HTTP/1.1 "+strconv.Itoa(int(status))+" "+StatusText(status)+"\r\n\r\n", buf.String())
+		assert.True(t, w.KeepAlive())
+
+		// Test: Framing headers from the handler are dropped and chunks refused
+		buf.Reset()
+		w = NewWriter(buf)
+		require.NoError(t, w.WriteStatusLine(status))
+		h := GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		require.NoError(t, w.WriteHeaders(*h))
+		_, err = w.WriteBody([]byte("x"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		_, err = w.WriteChunkedBody([]byte("x"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, "HTTP/1.1 "+strconv.Itoa(int(status))+" "+StatusText(status)+"\r\ncontent-type: text/plain\r\n\r\n", buf.String())
+	}
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	tests := []struct {
+		status StatusCode
+		line   string
+	}{
+		{StatusOk, "HTTP/1.1 200 OK\r\n"},
+		{StatusInternalServerError, "HTTP/1.1 500 Internal Server Error\r\n"},
+		{StatusTooManyRequests, "HTTP/1.1 429 Too Many Requests\r\n"},
+		{StatusEarlyHints, "HTTP/1.1 103 Early Hints\r\n"},
+		{StatusCode(299), "HTTP/1.1 299 \r\n"},
+	}
+
+	for _, tt := range tests {
+		buf := &bytes.Buffer{}
+		require.NoError(t, NewWriter(buf).WriteStatusLine(tt.status))
+		assert.Equal(t, tt.line, buf.String())
+	}
+
+	// Test: Status codes that are not three digits are refused
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.ErrorIs(t, w.WriteStatusLine(StatusCode(99)), ErrInvalidStatusCode)
+	assert.ErrorIs(t, w.WriteStatusLine(StatusCode(1000)), ErrInvalidStatusCode)
+	assert.Empty(t, buf.String())
+	assert.False(t, w.Written())
+
+	assert.Equal(t, "Not Found", StatusText(StatusNotFound))
+	assert.Equal(t, "", StatusText(StatusCode(299)))
+}
+
+func TestParseRange(t *testing.T) {
+	// Test: The three range forms
+	ranges, err := ParseRange("bytes=0-4, 10-, -3", 20)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 5}, {Start: 10, Length: 10}, {Start: 17, Length: 3}}, ranges)
+	assert.Equal(t, "bytes 0-4/20", ranges[0].ContentRange(20))
+
+	// Test: Ranges are cut at the end, those starting past it are dropped
+	ranges, err = ParseRange("bytes=15-100,30-40", 20)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 15, Length: 5}}, ranges)
+
+	ranges, err = ParseRange("bytes=-50", 20)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 20}}, ranges)
+
+	// Test: Nothing left to serve
+	_, err = ParseRange("bytes=20-", 20)
+	assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+	_, err = ParseRange("bytes=-0", 20)
+	assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+
+	// Test: Malformed headers
+	for _, header := range []string{"items=0-1", "bytes=1", "bytes=5-2", "bytes=a-b", "bytes=+1-2", "bytes=--1"} {
+		_, err = ParseRange(header, 20)
+		assert.ErrorIs(t, err, ErrInvalidRange, header)
+	}
+
+	// Test: Overlapping ranges asking for more than the whole
+	_, err = ParseRange("bytes=0-15,5-19", 20)
+	assert.ErrorIs(t, err, ErrTooManyRanges)
+}
+
+func TestEvaluatePreconditions(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	v := Validators{ETag: `"abc"`, LastModified: modTime}
+	weak := Validators{ETag: `W/"abc"`, LastModified: modTime}
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		v       Validators
+		status  StatusCode
+	}{
+		{"no conditions", "GET", nil, v, 0},
+		{"if-none-match hit", "GET", map[string]string{"If-None-Match": `"x", W/"abc"`}, v, StatusNotModified},
+		{"if-none-match miss", "GET", map[string]string{"If-None-Match": `"x"`}, v, 0},
+		{"if-none-match star", "HEAD", map[string]string{"If-None-Match": "*"}, v, StatusNotModified},
+		{"if-none-match on unsafe method", "PUT", map[string]string{"If-None-Match": "*"}, v, StatusPreconditionFailed},
+		{"if-none-match wins over if-modified-since", "GET", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, v, 0},
+		{"not modified since", "GET", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, v, StatusNotModified},
+		{"modified since", "GET", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 11:59:59 GMT"}, v, 0},
+		{"if-modified-since ignored for unsafe methods", "POST", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, v, 0},
+		{"malformed date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, v, 0},
+		{"if-match hit", "PUT", map[string]string{"If-Match": `"abc"`}, v, 0},
+		{"if-match miss", "PUT", map[string]string{"If-Match": `"x"`}, v, StatusPreconditionFailed},
+		{"if-match is strong", "PUT", map[string]string{"If-Match": `W/"abc"`}, weak, StatusPreconditionFailed},
+		{"if-match star without etag", "PUT", map[string]string{"If-Match": "*"}, Validators{}, StatusPreconditionFailed},
+		{"if-match wins over if-unmodified-since", "PUT", map[string]string{"If-Match": `"abc"`, "If-Unmodified-Since": "Tue, 30 Apr 2024 12:00:00 GMT"}, v, 0},
+		{"unmodified since", "DELETE", map[string]string{"If-Unmodified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, v, 0},
+		{"modified since unmodified-since", "DELETE", map[string]string{"If-Unmodified-Since": "Tue, 30 Apr 2024 12:00:00 GMT"}, v, StatusPreconditionFailed},
+		{"if-match checked before if-none-match", "GET", map[string]string{"If-Match": `"x"`, "If-None-Match": `"abc"`}, v, StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		h := headers.NewHeaders()
+		for k, val := range tt.headers {
+			h.Set(k, val)
+		}
+		assert.Equal(t, tt.status, EvaluatePreconditions(tt.method, h, tt.v), tt.name)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	body := []byte("hello")
+	etag := StrongETag(body)
+	assert.Equal(t, etag, StrongETag([]byte("hello")))
+	assert.NotEqual(t, etag, StrongETag([]byte("hellO")))
+	assert.True(t, strings.HasPrefix(WeakETag(time.Unix(1, 0), 5), `W/"`))
+
+	// Test: A matching request gets a bare 304 with the validators
+	reqHeaders := headers.NewHeaders()
+	reqHeaders.Set("If-None-Match", etag)
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.False(t, w.CheckPreconditions("GET", reqHeaders, Validators{ETag: etag}))
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\netag: "+etag+"\r\n\r\n", buf.String())
+
+	// Test: Otherwise the validators go out with the handler's response
+	buf.Reset()
+	w = NewWriter(buf)
+	assert.True(t, w.CheckPreconditions("GET", headers.NewHeaders(), Validators{ETag: etag}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(len(body))))
+	assert.Contains(t, buf.String(), "etag: "+etag+"\r\n")
+}
+
+func TestWriteHeadersFieldLines(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Headers().Add("Set-Cookie", "session=1")
+	w.Headers().Add("Set-Cookie", "theme=dark")
+
+	h := GetDefaultHeaders(0)
+	h.Add("Set-Cookie", "lang=en")
+	h.Add("X-First", "1")
+
+	// Test: Field lines go out in insertion order, Set-Cookie is never joined
+	// and the writer's own fields only fill in what h is missing
+	require.NoError(t, w.WriteHeaders(*h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"content-length: 0\r\n"+
+		"content-type: text/plain\r\n"+
+		"set-cookie: lang=en\r\n"+
+		"x-first: 1\r\n\r\n", buf.String())
+
+	buf.Reset()
+	w = NewWriter(buf)
+	w.Headers().Add("Set-Cookie", "session=1")
+	w.Headers().Add("Set-Cookie", "theme=dark")
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(0)))
+	assert.True(t, strings.HasSuffix(buf.String(), "set-cookie: session=1\r\nset-cookie: theme=dark\r\n\r\n"))
+}
+
+func TestWriteHeadersNameCase(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("content-length", "0")
+	h.Set("X-Request-ID", "abc")
+
+	write := func(writerCase, headersCase headers.NameCase) string {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		w.SetNameCase(writerCase)
+
+		h := *h
+		h.SetNameCase(headersCase)
+		require.NoError(t, w.WriteHeaders(h))
+		return buf.String()
+	}
+
+	// Test: Lower case by default
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 0\r\nx-request-id: abc\r\n\r\n", write(headers.CaseDefault, headers.CaseDefault))
+
+	// Test: The writer picks the case
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nX-Request-Id: abc\r\n\r\n", write(headers.CaseCanonical, headers.CaseDefault))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 0\r\nX-Request-ID: abc\r\n\r\n", write(headers.CaseOriginal, headers.CaseDefault))
+
+	// Test: Headers with a case of their own keep it
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 0\r\nx-request-id: abc\r\n\r\n", write(headers.CaseCanonical, headers.CaseLower))
+}
+
+func TestWriteHeadersLeavesCallerAlone(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	w.SetKeepAlive(false)
+	w.Headers().Set("X-Extra", "1")
+
+	h := GetDefaultHeaders(0)
+	h.Set("Connection", "keep-alive")
+
+	// Test: The fields the writer adds or changes stay in its own copy
+	require.NoError(t, w.WriteHeaders(*h))
+	connection, _ := h.Get("Connection")
+	assert.Equal(t, "keep-alive", connection)
+	_, ok := h.Get("X-Extra")
+	assert.False(t, ok)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// LogFormat is the line format of AccessLogFormat.
+type LogFormat int
+
+const (
+	// LogFormatCommon is the Common Log Format:
+	//   host ident authuser [date] "request line" status bytes
+	LogFormatCommon LogFormat = iota
+	// LogFormatCombined is the Common Log Format followed by the quoted
+	// Referer and User-Agent.
+	LogFormatCombined
+)
+
+// clfTime is the date layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessEntry is what is known about a request once it was handled.
+type accessEntry struct {
+	start      time.Time
+	duration   time.Duration
+	remoteAddr string
+	method     string
+	target     string
+	proto      string
+	status     response.StatusCode
+	bytes      int
+	userAgent  string
+	referer    string
+	requestID  string
+}
+
+// logAccess runs next and reports the request to log afterwards, even when
+// next panicked.
+func logAccess(log func(e *accessEntry)) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+
+			defer func() {
+				e := &accessEntry{
+					start:      start,
+					duration:   time.Since(start),
+					remoteAddr: req.RemoteAddr,
+					method:     req.RequestLine.Method,
+					target:     req.RequestLine.RequestTarget,
+					proto:      "HTTP/" + req.RequestLine.HTTPVersion,
+					status:     w.Status(),
+					bytes:      w.BytesWritten(),
+					requestID:  RequestIDFromContext(req.Context()),
+				}
+				e.userAgent, _ = req.Headers.Get("User-Agent")
+				e.referer, _ = req.Headers.Get("Referer")
+
+				// nothing was written or the handler panicked, the server
+				// sends a 500
+				if e.status == 0 {
+					e.status = response.StatusInternalServerError
+				}
+
+				log(e)
+			}()
+
+			next(w, req)
+		}
+	}
+}
+
+// AccessLog logs one record per request through logger, with the status and
+// body size the handler actually sent. Use a logger with a slog.JSONHandler
+// to get JSON lines. logger defaults to slog.Default.
+func AccessLog(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return logAccess(func(e *accessEntry) {
+		attrs := []any{
+			"remote_addr", e.remoteAddr,
+			"method", e.method,
+			"target", e.target,
+			"proto", e.proto,
+			"status", int(e.status),
+			"bytes", e.bytes,
+			"duration", e.duration,
+			"user_agent", e.userAgent,
+			"referer", e.referer,
+		}
+		if e.requestID != "" {
+			attrs = append(attrs, "request_id", e.requestID)
+		}
+
+		logger.Info("request", attrs...)
+	})
+}
+
+// AccessLogFormat writes one line per request to out in the Apache Common or
+// Combined Log Format. Every line goes out in a single Write.
+func AccessLogFormat(out io.Writer, format LogFormat) Middleware {
+	var mu sync.Mutex
+
+	return logAccess(func(e *accessEntry) {
+		host := e.remoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		bytes := "-"
+		if e.bytes > 0 {
+			bytes = strconv.Itoa(e.bytes)
+		}
+
+		line := fmt.Appendf(nil, "%s - - [%s] \"%s %s %s\" %d %s",
+			orDash(host),
+			e.start.Format(clfTime),
+			clfEscape(e.method),
+			clfEscape(e.target),
+			clfEscape(e.proto),
+			e.status,
+			bytes,
+		)
+		if format == LogFormatCombined {
+			line = fmt.Appendf(line, " \"%s\" \"%s\"", clfEscape(orDash(e.referer)), clfEscape(orDash(e.userAgent)))
+		}
+		line = append(line, '\n')
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		out.Write(line)
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfEscape keeps client controlled values from breaking out of their quotes
+// or forging extra lines.
+func clfEscape(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c > '~':
+			b = fmt.Appendf(b, "\\x%02x", c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
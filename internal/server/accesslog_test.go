@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		req.RemoteAddr = "192.0.2.7:51234"
+		body := []byte("hello")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	raw := "GET /search?q=\"x\" HTTP/1.1\r\nUser-Agent: curl/8.0\r\nReferer: http://example.com/\r\n\r\n"
+
+	// Test: Combined Log Format, quotes in the target are escaped
+	out := &bytes.Buffer{}
+	serveRaw(t, AccessLogFormat(out, LogFormatCombined)(handler), raw)
+	assert.Regexp(t, regexp.MustCompile(
+		`^192\.0\.2\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /search\?q=\\"x\\" HTTP/1\.1" 200 5 "http://example\.com/" "curl/8\.0"\n$`,
+	), out.String())
+
+	// Test: Common Log Format, empty bodies are logged as -
+	out.Reset()
+	serveRaw(t, AccessLogFormat(out, LogFormatCommon)(okHandler), "HEAD / HTTP/1.1\r\n\r\n")
+	assert.Regexp(t, regexp.MustCompile(`^- - - \[.+\] "HEAD / HTTP/1\.1" 200 -\n$`), out.String())
+
+	// Test: JSON through slog
+	out.Reset()
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	serveRaw(t, AccessLog(logger)(handler), raw)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "192.0.2.7:51234", record["remote_addr"])
+	assert.Equal(t, "HTTP/1.1", record["proto"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "curl/8.0", record["user_agent"])
+	assert.Equal(t, "http://example.com/", record["referer"])
+
+	// Test: A handler that wrote nothing is logged with the 500 the server sends
+	out.Reset()
+	buf := &bytes.Buffer{}
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	AccessLogFormat(out, LogFormatCommon)(func(w *response.Writer, req *request.Request) {})(response.NewWriter(buf), req)
+	assert.Regexp(t, regexp.MustCompile(`"GET / HTTP/1\.1" 500 -\n$`), out.String())
+}
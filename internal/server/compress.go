@@ -0,0 +1,196 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// DefaultCompressMinSize is the body size under which compressing costs more
+// than it saves.
+const DefaultCompressMinSize = 1024
+
+// codings are the content codings Compress offers, by order of preference.
+// "deflate" is the zlib format (RFC 9110 section 8.4.1.2), not a raw deflate
+// stream.
+var codings = []string{"gzip", "deflate"}
+
+// incompressibleTypes are Content-Type prefixes of formats that are
+// compressed already.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/pdf",
+	"application/octet-stream",
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(io.Discard) }}
+)
+
+// Compress encodes response bodies with gzip or deflate, whichever the client
+// prefers in Accept-Encoding. Bodies announcing a Content-Length under
+// minSize, partial content, bodies that already have a Content-Encoding and
+// already compressed formats such as video/mp4 or image/png are sent as they
+// are. A compressed body is sent chunked, and a strong ETag becomes weak since
+// the bytes are no longer those it was computed on.
+func Compress(minSize int) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+
+			w.SetEncoder(func(status response.StatusCode, h *headers.Headers, dst io.Writer) response.Encoder {
+				if !compressible(status, h, minSize) {
+					return nil
+				}
+
+				addVary(h, "Accept-Encoding")
+
+				coding := negotiateEncoding(acceptEncoding)
+				if coding == "" {
+					return nil
+				}
+
+				h.Set("Content-Encoding", coding)
+				if etag, ok := h.Get("ETag"); ok && !strings.HasPrefix(etag, "W/") {
+					h.Set("ETag", "W/"+etag)
+				}
+
+				return newEncoder(coding, dst)
+			})
+
+			next(w, req)
+		}
+	}
+}
+
+func compressible(status response.StatusCode, h *headers.Headers, minSize int) bool {
+	if status == response.StatusPartialContent {
+		return false
+	}
+
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return false
+	}
+
+	if cl, ok := h.Get("Content-Length"); ok {
+		if n, err := strconv.Atoi(cl); err == nil && n < minSize {
+			return false
+		}
+	}
+
+	contentType, _ := h.Get("Content-Type")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			// svg is text
+			return strings.HasPrefix(contentType, "image/svg+xml")
+		}
+	}
+
+	return true
+}
+
+// negotiateEncoding picks the coding to use for an Accept-Encoding value, ""
+// when the body should not be coded. Codings with a zero or malformed q-value
+// are refused, "*" stands for those not listed, and ties go by our own
+// preference. No Accept-Encoding at all gets no coding.
+func negotiateEncoding(acceptEncoding string) string {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return ""
+	}
+
+	weights := map[string]float64{}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		weights[coding] = qValue(params)
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range codings {
+		q, ok := weights[coding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// qValue reads the weight from the parameters of an Accept-Encoding item, one
+// by default and zero when it can not be parsed.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+
+	return 1
+}
+
+// addVary adds field to the Vary header of h unless it is listed already.
+func addVary(h *headers.Headers, field string) {
+	vary, _ := h.Get("Vary")
+	for _, f := range strings.Split(vary, ",") {
+		f = strings.TrimSpace(f)
+		if f == "*" || strings.EqualFold(f, field) {
+			return
+		}
+	}
+
+	h.Add("Vary", field)
+}
+
+func newEncoder(coding string, dst io.Writer) response.Encoder {
+	switch coding {
+	case "gzip":
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(dst)
+		return &pooledEncoder{Encoder: gz, release: func() { gzipWriters.Put(gz) }}
+	default:
+		zw := zlibWriters.Get().(*zlib.Writer)
+		zw.Reset(dst)
+		return &pooledEncoder{Encoder: zw, release: func() { zlibWriters.Put(zw) }}
+	}
+}
+
+// pooledEncoder hands its writer back to the pool once closed.
+type pooledEncoder struct {
+	response.Encoder
+	release func()
+}
+
+func (e *pooledEncoder) Close() error {
+	err := e.Encoder.Close()
+	e.release()
+	return err
+}
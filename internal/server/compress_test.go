@@ -0,0 +1,125 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		coding         string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP;Q=0.8, deflate;q=0.8", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"br, identity", ""},
+		{"gzip;q=2", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.coding, negotiateEncoding(tt.acceptEncoding), tt.acceptEncoding)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>hello compression</p>\n", 100)
+
+	serve := func(contentType, body, reqHeaders string) (*response.Writer, string, string) {
+		h := Compress(DefaultCompressMinSize)(func(w *response.Writer, req *request.Request) {
+			rh := response.GetDefaultHeaders(len(body))
+			rh.Set("Content-Type", contentType)
+			rh.Set("ETag", `"v1"`)
+
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(*rh)
+			w.WriteBody([]byte(body))
+		})
+
+		w, out := serveRaw(t, h, "GET / HTTP/1.1\r\n"+reqHeaders+"\r\n")
+		head, rest, _ := strings.Cut(out, "\r\n\r\n")
+		return w, head + "\r\n", rest
+	}
+
+	// Test: gzip bodies lose their length and go out chunked
+	w, head, body := serve("text/html", page, "Accept-Encoding: gzip, deflate\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, head, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, "etag: W/\"v1\"\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.True(t, w.KeepAlive())
+
+	zr, err := gzip.NewReader(httputil.NewChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(decoded))
+	assert.Less(t, w.BytesWritten(), len(page))
+
+	// Test: deflate is the zlib format
+	_, head, body = serve("text/html", page, "Accept-Encoding: deflate\r\n")
+	assert.Contains(t, head, "content-encoding: deflate\r\n")
+
+	zlr, err := zlib.NewReader(httputil.NewChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	decoded, err = io.ReadAll(zlr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(decoded))
+
+	// Test: Clients that do not ask get the body as is, but still learn it varies
+	_, head, body = serve("text/html", page, "")
+	assert.NotContains(t, head, "content-encoding")
+	assert.Contains(t, head, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, "content-length: "+strconv.Itoa(len(page))+"\r\n")
+	assert.Equal(t, page, body)
+
+	// Test: Compressed formats and tiny bodies are left alone
+	_, head, _ = serve("video/mp4", page, "Accept-Encoding: gzip\r\n")
+	assert.NotContains(t, head, "content-encoding")
+	assert.NotContains(t, head, "vary")
+
+	_, head, body = serve("text/plain", "tiny", "Accept-Encoding: gzip\r\n")
+	assert.NotContains(t, head, "content-encoding")
+	assert.Equal(t, "tiny", body)
+
+	// Test: svg is compressed despite being an image
+	_, head, _ = serve("image/svg+xml", page, "Accept-Encoding: gzip\r\n")
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+}
+
+func TestCompressStreaming(t *testing.T) {
+	h := Compress(DefaultCompressMinSize)(func(w *response.Writer, req *request.Request) {
+		w.WriteBody([]byte("first\n"))
+		w.WriteBody([]byte("second\n"))
+		w.WriteChunkedBodyDone()
+	})
+
+	// Test: Streamed writes are flushed through and the stream is closed by the last chunk
+	_, out := serveRaw(t, h, "GET / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n")
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	assert.Contains(t, out, "content-encoding: gzip\r\n")
+
+	zr, err := gzip.NewReader(httputil.NewChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(decoded))
+}
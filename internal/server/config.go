@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// Config tunes a Server, the zero value is ready to use.
+type Config struct {
+	// Network and Addr are handed to net.Listen by Server.Listen. Network is
+	// one of "tcp", "tcp4", "tcp6" or "unix" and defaults to "tcp", Addr is a
+	// host:port or, for "unix", a socket path.
+	Network string
+	Addr    string
+
+	// TLSConfig turns on TLS for every connection when set. The server works
+	// on a copy, "http/1.1" is offered through ALPN when NextProtos is empty.
+	TLSConfig *tls.Config
+
+	// ClientCAs turns on mutual TLS: clients have to present a certificate
+	// signed by one of these authorities. The verified chains are exposed on
+	// Request.TLS.
+	ClientCAs *x509.CertPool
+
+	// Limits bounds the size of incoming requests. Zero fields take the
+	// value of request.DefaultLimits, set one to request.NoLimit to turn it
+	// off.
+	Limits request.Limits
+
+	// HeaderCase is how response header names are written, lower case when
+	// it is headers.CaseDefault. Headers with a NameCase of their own keep
+	// it.
+	HeaderCase headers.NameCase
+
+	// Logger receives the server's own logs, slog.Default when nil.
+	Logger *slog.Logger
+
+	// ErrorRenderer writes the responses the server sends on its own: parse
+	// errors, handlers that panicked or returned without answering.
+	// DefaultErrorRenderer is used when it is nil.
+	ErrorRenderer ErrorRenderer
+
+	// OnPanic is called after a handler panicked, with the recovered value
+	// and the goroutine's stack. The panic is already logged and answered by
+	// then, the hook is meant for error trackers.
+	OnPanic func(req *request.Request, recovered any, stack []byte)
+
+	// Metrics, when set, observes every request, connection and parse error
+	// of the server.
+	Metrics *Metrics
+
+	// OnConnState is called every time a connection changes state.
+	OnConnState func(conn net.Conn, state ConnState)
+
+	// ReadHeaderTimeout bounds reading the request line and headers, counted
+	// from the first byte of the request. A client that runs out of time is
+	// answered with 408 Request Timeout. ReadTimeout is used when it is zero.
+	ReadHeaderTimeout time.Duration
+
+	// ReadTimeout bounds reading the whole request, body included.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds writing the response, counted from the end of the
+	// request headers.
+	WriteTimeout time.Duration
+
+	// IdleTimeout bounds how long a keep-alive connection may wait for its
+	// next request. ReadTimeout is used when it is zero.
+	IdleTimeout time.Duration
+
+	// MaxConns bounds the number of open connections and MaxInflight the
+	// number of requests handled at once, zero means no bound. Connections
+	// and requests over the bound wait up to QueueTimeout for a slot and are
+	// then answered with 503 Service Unavailable and a Retry-After header.
+	MaxConns    int
+	MaxInflight int
+
+	// QueueTimeout is how long to wait for a free slot, zero sheds right away.
+	QueueTimeout time.Duration
+
+	// RetryAfter is the delay suggested to shed clients, one second when zero.
+	RetryAfter time.Duration
+}
+
+// alpnHTTP11 is the ALPN protocol ID of HTTP/1.1, the only protocol served.
+const alpnHTTP11 = "http/1.1"
+
+// Option changes one setting of the Config a server is created with.
+type Option func(*Config)
+
+// WithConfig replaces the whole Config, options after it still apply.
+func WithConfig(config Config) Option {
+	return func(c *Config) {
+		*c = config
+	}
+}
+
+func WithAddr(addr string) Option {
+	return func(c *Config) {
+		c.Addr = addr
+	}
+}
+
+func WithNetwork(network string) Option {
+	return func(c *Config) {
+		c.Network = network
+	}
+}
+
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *Config) {
+		c.TLSConfig = tlsConfig
+	}
+}
+
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(c *Config) {
+		c.ClientCAs = pool
+	}
+}
+
+func WithLimits(limits request.Limits) Option {
+	return func(c *Config) {
+		c.Limits = limits
+	}
+}
+
+func WithHeaderCase(nameCase headers.NameCase) Option {
+	return func(c *Config) {
+		c.HeaderCase = nameCase
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+func WithErrorRenderer(render ErrorRenderer) Option {
+	return func(c *Config) {
+		c.ErrorRenderer = render
+	}
+}
+
+func WithOnPanic(onPanic func(req *request.Request, recovered any, stack []byte)) Option {
+	return func(c *Config) {
+		c.OnPanic = onPanic
+	}
+}
+
+func WithOnConnState(onConnState func(conn net.Conn, state ConnState)) Option {
+	return func(c *Config) {
+		c.OnConnState = onConnState
+	}
+}
+
+// WithMaxConns bounds the number of open connections.
+func WithMaxConns(n int) Option {
+	return func(c *Config) {
+		c.MaxConns = n
+	}
+}
+
+// WithMaxInflight bounds the number of requests handled at once.
+func WithMaxInflight(n int) Option {
+	return func(c *Config) {
+		c.MaxInflight = n
+	}
+}
+
+// WithQueueTimeout sets how long connections and requests over the bounds
+// wait before being shed, and the Retry-After sent when they are.
+func WithQueueTimeout(timeout, retryAfter time.Duration) Option {
+	return func(c *Config) {
+		c.QueueTimeout = timeout
+		c.RetryAfter = retryAfter
+	}
+}
+
+func WithMetrics(m *Metrics) Option {
+	return func(c *Config) {
+		c.Metrics = m
+	}
+}
+
+// WithTimeouts sets ReadHeaderTimeout, ReadTimeout, WriteTimeout and
+// IdleTimeout in one go.
+func WithTimeouts(readHeader, read, write, idle time.Duration) Option {
+	return func(c *Config) {
+		c.ReadHeaderTimeout = readHeader
+		c.ReadTimeout = read
+		c.WriteTimeout = write
+		c.IdleTimeout = idle
+	}
+}
+
+// withDefaults fills in whatever was left empty.
+func (c Config) withDefaults() Config {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+
+	c.Limits = c.Limits.WithDefaults()
+
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	if c.ErrorRenderer == nil {
+		c.ErrorRenderer = DefaultErrorRenderer
+	}
+
+	if c.TLSConfig != nil {
+		c.TLSConfig = c.TLSConfig.Clone()
+
+		if len(c.TLSConfig.NextProtos) == 0 {
+			c.TLSConfig.NextProtos = []string{alpnHTTP11}
+		}
+
+		if c.ClientCAs != nil {
+			c.TLSConfig.ClientCAs = c.ClientCAs
+			c.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return c
+}
+
+func (c *Config) headerTimeout() time.Duration {
+	if c.ReadHeaderTimeout > 0 {
+		return c.ReadHeaderTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return c.IdleTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c *Config) retryAfter() time.Duration {
+	if c.RetryAfter >= time.Second {
+		return c.RetryAfter
+	}
+	return time.Second
+}
+
+// deadline turns a timeout into a conn deadline, no timeout clears it.
+func deadline(from time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return from.Add(timeout)
+}
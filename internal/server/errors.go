@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// HandlerError is an error carrying the response it should be rendered as.
+// Message is shown to the client, Err is kept for logs only.
+type HandlerError struct {
+	StatusCode response.StatusCode
+	Message    string
+
+	// Headers are added to the error response, e.g. Allow on a 405.
+	Headers *headers.Headers
+
+	Err error
+}
+
+// NewHandlerError returns a HandlerError for status, an empty message falls
+// back to the status' reason phrase.
+func NewHandlerError(status response.StatusCode, message string) *HandlerError {
+	if message == "" {
+		message = response.StatusText(status)
+	}
+
+	return &HandlerError{
+		StatusCode: status,
+		Message:    message,
+	}
+}
+
+func (e *HandlerError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.StatusCode, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler is a Handler that reports failure by returning an error
+// instead of writing the error response itself, adapt it with HandleErrors.
+type ErrorHandler func(w *response.Writer, req *request.Request) error
+
+// ErrorRenderer writes the whole response for herr. req is nil when the
+// request could not be parsed.
+type ErrorRenderer func(w *response.Writer, req *request.Request, herr *HandlerError)
+
+// HandleErrors turns h into a Handler. A *HandlerError anywhere in the chain
+// of a returned error is rendered with its status and message, any other
+// error becomes a 500 that does not reveal what went wrong, the error itself
+// goes to logger. logger defaults to slog.Default and render to
+// DefaultErrorRenderer. If the response had already started there is nothing
+// sensible left to send, it is aborted instead.
+func HandleErrors(h ErrorHandler, logger *slog.Logger, render ErrorRenderer) Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		err := h(w, req)
+		if err == nil {
+			return
+		}
+
+		var herr *HandlerError
+		if !errors.As(err, &herr) {
+			logger.Error("handler failed",
+				"method", req.RequestLine.Method,
+				"target", req.RequestLine.RequestTarget,
+				"error", err,
+			)
+
+			herr = NewHandlerError(response.StatusInternalServerError, "")
+			herr.Err = err
+		}
+
+		if w.Written() {
+			w.Abort()
+			return
+		}
+
+		render(w, req, herr)
+	}
+}
+
+// DefaultErrorRenderer answers with a small html page showing the status and
+// the error message.
+func DefaultErrorRenderer(w *response.Writer, req *request.Request, herr *HandlerError) {
+	title := fmt.Sprintf("%d %s", herr.StatusCode, response.StatusText(herr.StatusCode))
+
+	body := fmt.Appendf(nil, `<html>
+  <head>
+    <title>%s</title>
+  </head>
+  <body>
+    <h1>%s</h1>
+    <p>%s</p>
+  </body>
+</html>
+`, html.EscapeString(title), html.EscapeString(title), html.EscapeString(herr.Message))
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html")
+
+	if herr.Headers != nil {
+		// the error's fields take the place of the defaults, every line of
+		// them is kept
+		herr.Headers.Map(func(k, v string) {
+			h.Delete(k)
+		})
+		herr.Headers.Each(func(name, v string) {
+			h.Add(name, v)
+		})
+	}
+
+	w.WriteStatusLine(herr.StatusCode)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func TestHandleErrors(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	logs := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(logs, nil))
+
+	serve := func(h ErrorHandler, render ErrorRenderer) (*response.Writer, string) {
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		HandleErrors(h, logger, render)(w, req)
+		return w, buf.String()
+	}
+
+	// Test: HandlerError is rendered with its status and message, even wrapped
+	_, out := serve(func(w *response.Writer, req *request.Request) error {
+		return fmt.Errorf("loading user: %w", NewHandlerError(response.StatusNotFound, "no such <user>"))
+	}, nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "<p>no such &lt;user&gt;</p>")
+
+	// Test: Other errors become a 500 without details
+	_, out = serve(func(w *response.Writer, req *request.Request) error {
+		return errors.New("db password is hunter2")
+	}, nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.NotContains(t, out, "hunter2")
+
+	// Test: They are logged through the given logger
+	assert.Contains(t, logs.String(), "level=ERROR")
+	assert.Contains(t, logs.String(), `error="db password is hunter2"`)
+
+	// Test: Custom renderer
+	_, out = serve(func(w *response.Writer, req *request.Request) error {
+		return NewHandlerError(response.StatusConflict, "")
+	}, func(w *response.Writer, req *request.Request, herr *HandlerError) {
+		w.WriteStatusLine(herr.StatusCode)
+		w.WriteHeaders(*response.GetDefaultHeaders(0))
+	})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 409 Conflict\r\n"))
+
+	// Test: Error after the response started aborts it
+	w, out := serve(func(w *response.Writer, req *request.Request) error {
+		w.WriteBody([]byte("partial"))
+		return errors.New("lost the database halfway")
+	}, nil)
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, response.StateDone, w.State())
+	assert.NotContains(t, out, "500")
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// indexPage is served for directories that contain it.
+const indexPage = "index.html"
+
+// FileHandler serves the files of a file system, see FileServer.
+type FileHandler struct {
+	root fs.FS
+
+	// ListDirectories serves an html listing for directories without an
+	// index.html, they are answered with 404 otherwise.
+	ListDirectories bool
+
+	// ErrorRenderer writes the error responses, DefaultErrorRenderer is used
+	// when it is nil.
+	ErrorRenderer ErrorRenderer
+}
+
+// FileServer returns a handler serving the files of root, the request path is
+// the file name relative to root. Paths are cleaned before use so ".." can not
+// escape root. Directories are served their index.html, the Content-Type is
+// taken from the file extension or sniffed from the first bytes, and files
+// are streamed rather than loaded in memory. Mount it under a prefix with
+// StripPrefix.
+func FileServer(root fs.FS) *FileHandler {
+	return &FileHandler{root: root}
+}
+
+// ServeHTTP serves the file named by the request path.
+func (f *FileHandler) ServeHTTP(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		herr := NewHandlerError(response.StatusMethodNotAllowed, "")
+		herr.Headers = headers.NewHeaders()
+		herr.Headers.Set("Allow", "GET, HEAD")
+
+		f.render(w, req, herr)
+		return
+	}
+
+	urlPath, err := url.PathUnescape(req.RequestLine.Path())
+	if err != nil || strings.ContainsRune(urlPath, 0) {
+		f.render(w, req, NewHandlerError(response.StatusBadRequest, ""))
+		return
+	}
+
+	name, isDir := resolve(urlPath)
+	f.serve(w, req, name, isDir)
+}
+
+// ServeFile serves the named file of the file system whatever the request
+// path is.
+func (f *FileHandler) ServeFile(w *response.Writer, req *request.Request, name string) {
+	name, _ = resolve(name)
+	f.serve(w, req, name, false)
+}
+
+// resolve turns a request path into a name for fs.FS, reporting whether the
+// path asked for a directory.
+func resolve(urlPath string) (string, bool) {
+	isDir := strings.HasSuffix(urlPath, "/")
+
+	// cleaning a rooted path drops every ".." that would climb above it
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	return name, isDir
+}
+
+func (f *FileHandler) serve(w *response.Writer, req *request.Request, name string, isDir bool) {
+	file, err := f.root.Open(name)
+	if err != nil {
+		f.renderFSError(w, req, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		f.renderFSError(w, req, err)
+		return
+	}
+
+	if !info.IsDir() {
+		f.serveContent(w, req, name, file, info)
+		return
+	}
+
+	// relative links in the page only resolve against a path ending in "/",
+	// the redirect is relative too so it works behind StripPrefix
+	if !isDir {
+		urlPath := req.RequestLine.Path()
+		location := urlPath[strings.LastIndex(urlPath, "/")+1:] + "/"
+		if query := req.RequestLine.Query(); query != "" {
+			location += "?" + query
+		}
+
+		f.redirect(w, location)
+		return
+	}
+
+	index, err := f.root.Open(path.Join(name, indexPage))
+	if err == nil {
+		defer index.Close()
+
+		if indexInfo, err := index.Stat(); err == nil && !indexInfo.IsDir() {
+			f.serveContent(w, req, indexPage, index, indexInfo)
+			return
+		}
+	}
+
+	if !f.ListDirectories {
+		f.render(w, req, NewHandlerError(response.StatusNotFound, ""))
+		return
+	}
+
+	f.serveListing(w, req, name)
+}
+
+func (f *FileHandler) serveContent(w *response.Writer, req *request.Request, name string, file fs.File, info fs.FileInfo) {
+	// sniff from the first bytes, then hand them back in front of the rest
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.renderFSError(w, req, err)
+		return
+	}
+	head = head[:n]
+
+	contentType := contentTypeFor(name, head)
+	size := info.Size()
+
+	// hashing every file on every request is too costly, the tag is weak
+	validators := response.Validators{LastModified: info.ModTime()}
+	if !info.ModTime().IsZero() {
+		validators.ETag = response.WeakETag(info.ModTime(), size)
+	}
+	if !w.CheckPreconditions(req.RequestLine.Method, req.Headers, validators) {
+		return
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Set("Content-Type", contentType)
+
+	body := io.MultiReader(bytes.NewReader(head), file)
+
+	// ranges need a file that can seek, others are always sent whole
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		h.Set("Accept-Ranges", "bytes")
+
+		rangeHeader, ok := req.Headers.Get("Range")
+		if ok && req.RequestLine.Method == "GET" && ifRange(req, validators) {
+			ranges, err := response.ParseRange(rangeHeader, size)
+			switch {
+			case err == nil:
+				f.serveRanges(w, req, seeker, ranges, size, contentType, h)
+				return
+
+			case errors.Is(err, response.ErrRangeNotSatisfiable):
+				herr := NewHandlerError(response.StatusRangeNotSatisfiable, "")
+				herr.Headers = headers.NewHeaders()
+				herr.Headers.Set("Content-Range", response.UnsatisfiedRange(size))
+
+				f.render(w, req, herr)
+				return
+			}
+
+			// a malformed or abusive Range header is ignored
+		}
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(*h)
+
+	// the writer would drop the body anyway, reading the file is wasted
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		// the client only finds out from the connection being closed
+		w.Abort()
+	}
+}
+
+// ifRange reports whether the Range header applies, that is when there is no
+// If-Range or when it still matches the file. An entity tag has to match the
+// ETag of v strongly, a date has to be its modification time.
+func ifRange(req *request.Request, v response.Validators) bool {
+	cond, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+
+	if strings.HasPrefix(cond, `"`) || strings.HasPrefix(cond, "W/") {
+		return v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") && v.ETag == cond
+	}
+
+	date, err := time.Parse(response.TimeFormat, cond)
+	if err != nil || v.LastModified.IsZero() {
+		return false
+	}
+	return v.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// serveRanges answers with 206 Partial Content, a single range is sent as is
+// and several ones as a multipart/byteranges body.
+func (f *FileHandler) serveRanges(w *response.Writer, req *request.Request, file io.ReadSeeker, ranges []response.ByteRange, size int64, contentType string, h *headers.Headers) {
+	if len(ranges) == 1 {
+		r := ranges[0]
+		h.Set("Content-Length", strconv.FormatInt(r.Length, 10))
+		h.Set("Content-Range", r.ContentRange(size))
+
+		w.WriteStatusLine(response.StatusPartialContent)
+		w.WriteHeaders(*h)
+
+		if err := copyRange(w, file, r); err != nil {
+			w.Abort()
+		}
+		return
+	}
+
+	boundary := newBoundary()
+
+	// the part headers are known up front, which gives the Content-Length
+	parts := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		parts[i] = fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.ContentRange(size))
+		length += int64(len(parts[i])) + r.Length + int64(len("\r\n"))
+	}
+	closing := "--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+
+	w.WriteStatusLine(response.StatusPartialContent)
+	w.WriteHeaders(*h)
+
+	for i, r := range ranges {
+		if _, err := w.WriteBody([]byte(parts[i])); err != nil {
+			w.Abort()
+			return
+		}
+		if err := copyRange(w, file, r); err != nil {
+			w.Abort()
+			return
+		}
+		if _, err := w.WriteBody([]byte("\r\n")); err != nil {
+			w.Abort()
+			return
+		}
+	}
+
+	w.WriteBody([]byte(closing))
+}
+
+func copyRange(w io.Writer, file io.ReadSeeker, r response.ByteRange) error {
+	if _, err := file.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(w, file, r.Length)
+	return err
+}
+
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (f *FileHandler) serveListing(w *response.Writer, req *request.Request, name string) {
+	entries, err := fs.ReadDir(f.root, name)
+	if err != nil {
+		f.renderFSError(w, req, err)
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	title := html.EscapeString(req.RequestLine.Path())
+	body := fmt.Appendf(nil, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n    <ul>\n", title, title)
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+
+		link := (&url.URL{Path: entryName}).EscapedPath()
+		body = fmt.Appendf(body, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(entryName))
+	}
+	body = fmt.Append(body, "    </ul>\n  </body>\n</html>\n")
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+func (f *FileHandler) redirect(w *response.Writer, location string) {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+
+	w.WriteStatusLine(response.StatusMovedPermanently)
+	w.WriteHeaders(*h)
+}
+
+func (f *FileHandler) renderFSError(w *response.Writer, req *request.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		f.render(w, req, NewHandlerError(response.StatusNotFound, ""))
+	case errors.Is(err, fs.ErrPermission):
+		f.render(w, req, NewHandlerError(response.StatusForbidden, ""))
+	default:
+		herr := NewHandlerError(response.StatusInternalServerError, "")
+		herr.Err = err
+		f.render(w, req, herr)
+	}
+}
+
+func (f *FileHandler) render(w *response.Writer, req *request.Request, herr *HandlerError) {
+	render := f.ErrorRenderer
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+	render(w, req, herr)
+}
+
+// StripPrefix serves requests whose path is under prefix with h, after
+// removing prefix from the request target. The prefix has to end on a path
+// segment: "/static" takes "/static" and "/static/app.js" but not
+// "/staticsecret.txt". Other requests get a 404, written by render which
+// defaults to DefaultErrorRenderer.
+func StripPrefix(prefix string, h Handler, render ErrorRenderer) Handler {
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		rest, ok := strings.CutPrefix(req.RequestLine.Path(), prefix)
+		if !ok || (rest != "" && rest[0] != '/' && !strings.HasSuffix(prefix, "/")) {
+			render(w, req, NewHandlerError(response.StatusNotFound, ""))
+			return
+		}
+
+		target := "/" + strings.TrimPrefix(rest, "/")
+		if query := req.RequestLine.Query(); query != "" {
+			target += "?" + query
+		}
+
+		stripped := *req
+		stripped.RequestLine.RequestTarget = target
+		h(w, &stripped)
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func TestFileServer(t *testing.T) {
+	root := fstest.MapFS{
+		"hello.txt":           {Data: []byte("hello, world\n")},
+		"noext":               {Data: []byte("\x89PNG\r\n\x1a\n....")},
+		"site/index.html":     {Data: []byte("<h1>home</h1>")},
+		"docs/a b.md":         {Data: []byte("# a")},
+		"docs/nested/file.js": {Data: []byte("let x = 1")},
+	}
+	files := FileServer(root)
+
+	get := func(raw string) string {
+		_, out := serveRaw(t, files.ServeHTTP, raw)
+		return out
+	}
+
+	// Test: File with a known extension
+	out := get("GET /hello.txt HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, out, "content-length: 13\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello, world\n"))
+
+	// Test: Content-Type is sniffed when the extension says nothing
+	out = get("GET /noext HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "content-type: image/png\r\n")
+
+	// Test: Traversal stays inside the root
+	out = get("GET /../../etc/passwd HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = get("GET /docs/%2e%2e/hello.txt HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "hello, world\n"))
+
+	// Test: Directories are redirected to their slash form, then get their index
+	out = get("GET /site?x=1 HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, out, "location: site/?x=1\r\n")
+
+	out = get("GET /site/ HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(out, "<h1>home</h1>"))
+
+	// Test: Listings are opt-in
+	out = get("GET /docs/ HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	files.ListDirectories = true
+	out = get("GET /docs/ HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, `<li><a href="a%20b.md">a b.md</a></li>`)
+	assert.Contains(t, out, `<li><a href="nested/">nested/</a></li>`)
+
+	// Test: HEAD gets the headers only, the connection stays usable
+	w, out := serveRaw(t, func(w *response.Writer, req *request.Request) {
+		w.SetHead(true)
+		files.ServeHTTP(w, req)
+	}, "HEAD /hello.txt HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "content-length: 13\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, 0, w.BytesWritten())
+
+	// Test: Other methods
+	out = get("POST /hello.txt HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD\r\n")
+
+	// Test: StripPrefix mounts the files under a path
+	_, out = serveRaw(t, StripPrefix("/static", files.ServeHTTP, nil), "GET /static/hello.txt HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "hello, world\n"))
+
+	// Test: StripPrefix keeps the query and leaves the original request alone
+	var target string
+	inner := func(w *response.Writer, req *request.Request) {
+		target = req.RequestLine.RequestTarget
+		okHandler(w, req)
+	}
+	req, err := request.RequestFromReader(strings.NewReader("GET /static/a?b=c HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	StripPrefix("/static", inner, nil)(response.NewWriter(io.Discard), req)
+	assert.Equal(t, "/a?b=c", target)
+	assert.Equal(t, "/static/a?b=c", req.RequestLine.RequestTarget)
+
+	// Test: StripPrefix only strips whole path segments
+	notFound := func(w *response.Writer, req *request.Request, herr *HandlerError) {
+		target = "rendered " + strconv.Itoa(int(herr.StatusCode))
+		okHandler(w, req)
+	}
+	serveRaw(t, StripPrefix("/static", inner, notFound), "GET /staticsecret.txt HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "rendered 404", target)
+
+	serveRaw(t, StripPrefix("/static/", inner, notFound), "GET /static/app.js HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "/app.js", target)
+}
+
+func TestDetectContentType(t *testing.T) {
+	assert.Equal(t, "text/html; charset=utf-8", detectContentType([]byte("  <!DOCTYPE html><html>")))
+	assert.Equal(t, "text/xml; charset=utf-8", detectContentType([]byte("<?xml version=\"1.0\"?>")))
+	assert.Equal(t, "application/pdf", detectContentType([]byte("%PDF-1.7")))
+	assert.Equal(t, "video/mp4", detectContentType([]byte("\x00\x00\x00\x20ftypisom")))
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("héllo")))
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("h\xc3")))
+	assert.Equal(t, "application/octet-stream", detectContentType([]byte("\x00\x01\x02binary")))
+}
+
+func TestFileServerRanges(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := fstest.MapFS{
+		"digits.txt": {Data: []byte("0123456789"), ModTime: modTime},
+	}
+	files := FileServer(root)
+
+	get := func(headers string) string {
+		_, out := serveRaw(t, files.ServeHTTP, "GET /digits.txt HTTP/1.1\r\n"+headers+"\r\n")
+		return out
+	}
+
+	// Test: Full responses advertise ranges
+	out := get("")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "accept-ranges: bytes\r\n")
+	assert.Contains(t, out, "last-modified: Wed, 01 May 2024 12:00:00 GMT\r\n")
+
+	// Test: Single range
+	out = get("Range: bytes=2-4\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, out, "content-range: bytes 2-4/10\r\n")
+	assert.Contains(t, out, "content-length: 3\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n234"))
+
+	// Test: Several ranges make a multipart body of the announced length
+	out = get("Range: bytes=0-1,-2\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+
+	contentType := regexp.MustCompile(`content-type: multipart/byteranges; boundary=(\w+)\r\n`).FindStringSubmatch(out)
+	require.Len(t, contentType, 2)
+	boundary := contentType[1]
+
+	body := out[strings.Index(out, "\r\n\r\n")+4:]
+	assert.Equal(t, "--"+boundary+"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-1/10\r\n\r\n01\r\n"+
+		"--"+boundary+"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 8-9/10\r\n\r\n89\r\n"+
+		"--"+boundary+"--\r\n", body)
+	assert.Contains(t, out, fmt.Sprintf("content-length: %d\r\n", len(body)))
+
+	// Test: Unsatisfiable ranges
+	out = get("Range: bytes=10-\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, out, "content-range: bytes */10\r\n")
+
+	// Test: Malformed ranges are ignored
+	out = get("Range: bytes=5-1\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: If-Range only lets the range through while the file is unchanged
+	out = get("Range: bytes=0-0\r\nIf-Range: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+
+	out = get("Range: bytes=0-0\r\nIf-Range: Tue, 30 Apr 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "0123456789"))
+}
+
+func TestFileServerConditional(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := fstest.MapFS{
+		"digits.txt": {Data: []byte("0123456789"), ModTime: modTime},
+	}
+	files := FileServer(root)
+
+	get := func(headers string) string {
+		_, out := serveRaw(t, files.ServeHTTP, "GET /digits.txt HTTP/1.1\r\n"+headers+"\r\n")
+		return out
+	}
+
+	out := get("")
+	match := regexp.MustCompile(`etag: (W/"\w+-\w+")\r\n`).FindStringSubmatch(out)
+	require.Len(t, match, 2)
+	etag := match[1]
+
+	// Test: Unchanged files are not sent again
+	out = get("If-None-Match: " + etag + "\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "last-modified: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	out = get("If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+
+	// Test: Changed files are
+	out = get("If-Modified-Since: Tue, 30 Apr 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "0123456789"))
+
+	// Test: A weak tag never satisfies If-Match or If-Range
+	out = get("If-Match: " + etag + "\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"))
+
+	out = get("Range: bytes=0-0\r\nIf-Range: " + etag + "\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// shedLinger bounds the time spent on a connection that is turned away.
+const shedLinger = time.Second
+
+// Stats is a snapshot of the server's load.
+type Stats struct {
+	// ActiveConns is the number of open connections.
+	ActiveConns int64
+	// InflightRequests is the number of requests being handled.
+	InflightRequests int64
+	// ShedConns counts the connections turned away by MaxConns.
+	ShedConns uint64
+	// ShedRequests counts the requests turned away by MaxInflight.
+	ShedRequests uint64
+}
+
+type stats struct {
+	activeConns      atomic.Int64
+	inflightRequests atomic.Int64
+	shedConns        atomic.Uint64
+	shedRequests     atomic.Uint64
+}
+
+// Stats returns the server's current counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ActiveConns:      s.stats.activeConns.Load(),
+		InflightRequests: s.stats.inflightRequests.Load(),
+		ShedConns:        s.stats.shedConns.Load(),
+		ShedRequests:     s.stats.shedRequests.Load(),
+	}
+}
+
+// semaphore bounds how many of something can run at once, a nil semaphore
+// has no bound.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire takes a slot, waiting up to timeout for one to free up. It gives up
+// early when ctx is done.
+func (sem semaphore) acquire(ctx context.Context, timeout time.Duration) bool {
+	if sem == nil {
+		return true
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (sem semaphore) release() {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// retryAfter is the error sent back to shed clients.
+func (s *Server) retryAfter() *HandlerError {
+	herr := NewHandlerError(response.StatusServiceUnavailable, "")
+	herr.Headers = headers.NewHeaders()
+	herr.Headers.Set("Retry-After", strconv.Itoa(int(s.config.retryAfter().Seconds())))
+	return herr
+}
+
+// shedConn turns away a connection over MaxConns without reading its
+// request.
+func (s *Server) shedConn(conn net.Conn) {
+	defer conn.Close()
+	s.stats.shedConns.Add(1)
+
+	conn.SetDeadline(time.Now().Add(shedLinger))
+
+	respWriter := s.newWriter(conn)
+	respWriter.SetKeepAlive(false)
+
+	s.config.ErrorRenderer(respWriter, nil, s.retryAfter())
+
+	// closing with the request still unread makes the kernel reset the
+	// connection, which can destroy the 503 before the client reads it
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
+
+// shedRequest answers a request over MaxInflight, the connection is closed
+// afterwards to take some load off.
+func (s *Server) shedRequest(w *response.Writer, req *request.Request) {
+	s.stats.shedRequests.Add(1)
+
+	w.SetKeepAlive(false)
+	s.config.ErrorRenderer(w, req, s.retryAfter())
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+var (
+	// latencyBuckets are the upper bounds, in seconds, of the request
+	// duration histogram.
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// sizeBuckets are the upper bounds, in bytes, of the body size
+	// histograms.
+	sizeBuckets = []float64{100, 1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20}
+)
+
+// parseErrorLabels names the request errors in the parse error counter, the
+// first match wins.
+var parseErrorLabels = []struct {
+	err   error
+	label string
+}{
+	{os.ErrDeadlineExceeded, "timeout"},
+	{io.ErrUnexpectedEOF, "unexpected_eof"},
+	{request.ErrBadStartLine, "bad_start_line"},
+	{request.ErrIncompleteStartLine, "incomplete_start_line"},
+	{request.ErrUnsupportedHTTPVersion, "unsupported_http_version"},
+	{request.ErrMalformedChunk, "malformed_chunk"},
+	{request.ErrUnsupportedTransferEncoding, "unsupported_transfer_encoding"},
+	{request.ErrInvalidContentLength, "invalid_content_length"},
+	{request.ErrAmbiguousFraming, "ambiguous_framing"},
+	{request.ErrRequestLineTooLong, "request_line_too_long"},
+	{request.ErrHeadersTooLarge, "headers_too_large"},
+	{request.ErrTooManyHeaders, "too_many_headers"},
+	{request.ErrBodyTooLarge, "body_too_large"},
+	{headers.ErrMalformedHeader, "malformed_header"},
+	{headers.ErrMalformedFieldName, "malformed_field_name"},
+}
+
+// unmatchedRoute is the route label of requests no mux pattern matched.
+const unmatchedRoute = "unmatched"
+
+// otherMethod is the method label of requests whose method is not one of
+// knownMethods, clients pick the method and could otherwise add series at
+// will.
+const otherMethod = "other"
+
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}
+
+// Metrics collects request, connection and parse error metrics and serves
+// them in the Prometheus text exposition format. Hand it to a server with
+// WithMetrics and mount ServeHTTP on a route to expose them.
+type Metrics struct {
+	mu sync.Mutex
+
+	requests      map[requestLabels]uint64
+	latency       map[routeLabels]*histogram
+	requestSizes  map[routeLabels]*histogram
+	responseSizes map[routeLabels]*histogram
+	conns         map[ConnState]int64
+	parseErrors   map[string]uint64
+}
+
+type routeLabels struct {
+	method string
+	route  string
+}
+
+type requestLabels struct {
+	routeLabels
+	status string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:      map[requestLabels]uint64{},
+		latency:       map[routeLabels]*histogram{},
+		requestSizes:  map[routeLabels]*histogram{},
+		responseSizes: map[routeLabels]*histogram{},
+		conns:         map[ConnState]int64{},
+		parseErrors:   map[string]uint64{},
+	}
+}
+
+// histogram is a cumulative histogram over fixed buckets.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// routeKey is the context key of the slot the mux writes the matched
+// pattern to, it survives the request copies made by WithContext.
+type routeKey struct{}
+
+// setRoute records the pattern that matched req.
+func setRoute(req *request.Request, pattern string) {
+	req.Pattern = pattern
+	if slot, ok := req.Context().Value(routeKey{}).(*string); ok {
+		*slot = pattern
+	}
+}
+
+// middleware observes every request passing through it.
+func (m *Metrics) middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+
+			route := new(string)
+			req = req.WithContext(context.WithValue(req.Context(), routeKey{}, route))
+
+			body := &countingReader{ReadCloser: req.Body}
+			req.Body = body
+
+			defer func() {
+				m.observeRequest(req.RequestLine.Method, *route, w.Status(), time.Since(start), body.n, w.BytesWritten())
+			}()
+
+			next(w, req)
+		}
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (m *Metrics) observeRequest(method, route string, status response.StatusCode, duration time.Duration, requestSize int64, responseSize int) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+
+	if !slices.Contains(knownMethods, method) {
+		method = otherMethod
+	}
+
+	// the handler panicked before answering, the server sends a 500
+	if status == 0 {
+		status = response.StatusInternalServerError
+	}
+
+	labels := routeLabels{method: method, route: route}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestLabels{routeLabels: labels, status: strconv.Itoa(int(status))}]++
+	observe(m.latency, labels, latencyBuckets, duration.Seconds())
+	observe(m.requestSizes, labels, sizeBuckets, float64(requestSize))
+	observe(m.responseSizes, labels, sizeBuckets, float64(responseSize))
+}
+
+func observe(histograms map[routeLabels]*histogram, labels routeLabels, buckets []float64, v float64) {
+	h, ok := histograms[labels]
+	if !ok {
+		h = newHistogram(buckets)
+		histograms[labels] = h
+	}
+	h.observe(v)
+}
+
+// connStateChanged moves a connection from one gauge to the other, from is
+// ignored for new connections.
+func (m *Metrics) connStateChanged(from ConnState, known bool, to ConnState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if known {
+		m.conns[from]--
+	}
+	if to != ConnClosed {
+		m.conns[to]++
+	}
+}
+
+func (m *Metrics) parseError(err error) {
+	label := "other"
+	for _, l := range parseErrorLabels {
+		if errors.Is(err, l.err) {
+			label = l.label
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.parseErrors[label]++
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w *response.Writer, req *request.Request) {
+	body := m.appendText(nil)
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func (m *Metrics) appendText(b []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b = appendHeader(b, "http_requests_total", "counter", "Requests handled, by method, route and status.")
+	for _, labels := range sortedKeys(m.requests, func(l requestLabels) string { return l.method + " " + l.route + " " + l.status }) {
+		b = appendSample(b, "http_requests_total", labelPairs("method", labels.method, "route", labels.route, "status", labels.status), float64(m.requests[labels]))
+	}
+
+	b = appendHistograms(b, "http_request_duration_seconds", "Time spent handling requests, by method and route.", m.latency)
+	b = appendHistograms(b, "http_request_size_bytes", "Request body bytes read by handlers, by method and route.", m.requestSizes)
+	b = appendHistograms(b, "http_response_size_bytes", "Response body bytes written, by method and route.", m.responseSizes)
+
+	b = appendHeader(b, "http_connections", "gauge", "Open connections, by state.")
+	for _, state := range []ConnState{ConnNew, ConnIdle, ConnActive} {
+		b = appendSample(b, "http_connections", labelPairs("state", state.String()), float64(m.conns[state]))
+	}
+
+	var open int64
+	for _, n := range m.conns {
+		open += n
+	}
+	b = appendHeader(b, "http_open_connections", "gauge", "Open connections.")
+	b = appendSample(b, "http_open_connections", "", float64(open))
+
+	b = appendHeader(b, "http_parse_errors_total", "counter", "Requests that could not be parsed, by error.")
+	for _, label := range sortedKeys(m.parseErrors, func(l string) string { return l }) {
+		b = appendSample(b, "http_parse_errors_total", labelPairs("error", label), float64(m.parseErrors[label]))
+	}
+
+	return b
+}
+
+func appendHistograms(b []byte, name, help string, histograms map[routeLabels]*histogram) []byte {
+	b = appendHeader(b, name, "histogram", help)
+
+	for _, labels := range sortedKeys(histograms, func(l routeLabels) string { return l.method + " " + l.route }) {
+		h := histograms[labels]
+		pairs := labelPairs("method", labels.method, "route", labels.route)
+
+		for i, bound := range h.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			b = appendSample(b, name+"_bucket", pairs+","+labelPairs("le", le), float64(h.counts[i]))
+		}
+		b = appendSample(b, name+"_bucket", pairs+","+labelPairs("le", "+Inf"), float64(h.count))
+		b = appendSample(b, name+"_sum", pairs, h.sum)
+		b = appendSample(b, name+"_count", pairs, float64(h.count))
+	}
+
+	return b
+}
+
+func appendHeader(b []byte, name, kind, help string) []byte {
+	return fmt.Appendf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func appendSample(b []byte, name, labels string, v float64) []byte {
+	b = append(b, name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	return append(b, '\n')
+}
+
+// labelPairs formats name, value, name, value... as name="value",...
+func labelPairs(pairs ...string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(pairs[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(pairs[i+1]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedKeys keeps the exposition stable between scrapes.
+func sortedKeys[K comparable, V any](m map[K]V, key func(K) string) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(key(a), key(b))
+	})
+	return keys
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+
+	mux := NewServeMux()
+	mux.Handle("GET", "/users/{id}", okHandler)
+	mux.Handle("GET", "/metrics", metrics.ServeHTTP)
+
+	s, err := Serve(0, Chain(mux.ServeHTTP, RequestID()), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+
+		// the server may reset connections it gave up on, only the
+		// metrics response matters
+		out, _ := io.ReadAll(conn)
+		return string(out)
+	}
+
+	send("GET /users/1 HTTP/1.1\r\nConnection: close\r\n\r\n")
+	send("GET /users/2 HTTP/1.1\r\nConnection: close\r\n\r\n")
+	send("GET /nope HTTP/1.1\r\nConnection: close\r\n\r\n")
+	send("GARBAGE\r\n\r\n")
+	send("GET /" + strings.Repeat("a", 10<<10) + " HTTP/1.1\r\n\r\n")
+
+	out := send("GET /metrics HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+
+	// Test: Requests are counted by route pattern, even through copies of the
+	// request made by middlewares
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/users/{id}",status="200"} 2`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="unmatched",status="404"} 1`+"\n")
+
+	// Test: Histograms
+	assert.Contains(t, out, "# TYPE http_request_duration_seconds histogram\n")
+	assert.Contains(t, out, `http_request_duration_seconds_bucket{method="GET",route="/users/{id}",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/users/{id}"} 2`+"\n")
+	assert.Contains(t, out, `http_response_size_bytes_bucket{method="GET",route="unmatched",le="100"} 0`+"\n")
+
+	// Test: Parse errors by kind
+	assert.Contains(t, out, `http_parse_errors_total{error="bad_start_line"} 1`+"\n")
+	assert.Contains(t, out, `http_parse_errors_total{error="request_line_too_long"} 1`+"\n")
+
+	// Test: The scraping connection is the only one open
+	assert.Contains(t, out, `http_connections{state="active"} 1`+"\n")
+	assert.Contains(t, out, "http_open_connections 1\n")
+}
+
+func TestLabelEscaping(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.observeRequest("GET", "/a\"b\\c\n", response.StatusOk, 0, 0, 0)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	metrics.ServeHTTP(w, &request.Request{})
+
+	assert.True(t, strings.Contains(buf.String(), `route="/a\"b\\c\n"`))
+}
+
+func TestMetricsUnknownMethods(t *testing.T) {
+	metrics := NewMetrics()
+	for i := range 10 {
+		metrics.observeRequest(fmt.Sprintf("FOO%d", i), "/", response.StatusOk, 0, 0, 0)
+	}
+	metrics.observeRequest("PATCH", "/", response.StatusOk, 0, 0, 0)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	metrics.ServeHTTP(w, &request.Request{})
+
+	// Test: Methods outside the standard set share one series
+	out := buf.String()
+	assert.Contains(t, out, `http_requests_total{method="other",route="/",status="200"} 10`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="PATCH",route="/",status="200"} 1`+"\n")
+	assert.NotContains(t, out, "FOO")
+}
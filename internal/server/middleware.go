@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// Middleware wraps a Handler with logic that runs around it.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with middlewares. The first middleware is the outermost one,
+// it sees the request first and the response last.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// RequestIDHeader carries the request ID, it is read from the request and
+// echoed on the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds the IDs accepted from clients.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestID tags every request with an ID, the one sent by the client in
+// X-Request-ID when it looks sane, a random one otherwise. The ID is sent
+// back in the response headers and can be read with RequestIDFromContext.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id, ok := req.Headers.Get(RequestIDHeader)
+			if !ok || !validRequestID(id) {
+				id = newRequestID()
+			}
+
+			w.Headers().Set(RequestIDHeader, id)
+			next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		}
+	}
+}
+
+// RequestIDFromContext returns the ID set by RequestID, "" when there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Recover turns a panic in the handlers it wraps into a 500, like the server
+// does on its own, but inside the chain so that the middlewares around it see
+// the response. The connection is closed afterwards. logger defaults to
+// slog.Default and render to DefaultErrorRenderer.
+func Recover(logger *slog.Logger, render ErrorRenderer) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				logger.Error("panic serving request",
+					"method", req.RequestLine.Method,
+					"target", req.RequestLine.RequestTarget,
+					"panic", recovered,
+					"stack", string(debug.Stack()),
+				)
+
+				if w.Written() {
+					w.Abort()
+					return
+				}
+
+				w.SetKeepAlive(false)
+				render(w, req, NewHandlerError(response.StatusInternalServerError, ""))
+			}()
+
+			next(w, req)
+		}
+	}
+}
+
+// Timeout gives the handlers it wraps d to finish. Past that the request's
+// context is cancelled and the client gets a 503, or a cut short response if
+// the handler already started answering. The handler keeps running until it
+// notices the context but its writes fail. render defaults to
+// DefaultErrorRenderer.
+func Timeout(d time.Duration, render ErrorRenderer) Middleware {
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			req = req.WithContext(ctx)
+
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+
+			go func() {
+				defer close(done)
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						panicked <- recovered
+					}
+				}()
+
+				next(w, req)
+			}()
+
+			select {
+			case <-done:
+				// hand the panic over to the server's goroutine
+				select {
+				case recovered := <-panicked:
+					panic(recovered)
+				default:
+				}
+
+			case <-ctx.Done():
+				w.Interrupt(func(w *response.Writer) {
+					render(w, req, NewHandlerError(response.StatusServiceUnavailable, "The request took too long."))
+				})
+			}
+		}
+	}
+}
+
+// MaxBodySize turns away requests whose body is larger than n bytes with 413
+// Content Too Large. Bodies without a Content-Length are cut off at n bytes,
+// reading further fails with request.ErrBodyTooLarge and the connection is
+// closed after the response. render defaults to DefaultErrorRenderer.
+func MaxBodySize(n int64, render ErrorRenderer) Middleware {
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if contentLen := req.ContentLength(); contentLen > n {
+				w.SetKeepAlive(false)
+				render(w, req, NewHandlerError(response.StatusContentTooLarge, ""))
+				return
+			}
+
+			req.LimitBody(n, func() { w.SetKeepAlive(false) })
+			next(w, req)
+		}
+	}
+}
+
+// DecodeBody decompresses gzip and deflate request bodies before the handler
+// reads them, see request.Request.DecodeBody. maxBytes caps the decoded body,
+// reading past it fails with request.ErrBodyTooLarge. Requests in any other
+// coding get 415 Unsupported Media Type, with the codings we accept listed in
+// Accept-Encoding. render defaults to DefaultErrorRenderer.
+func DecodeBody(maxBytes int64, render ErrorRenderer) Middleware {
+	if render == nil {
+		render = DefaultErrorRenderer
+	}
+
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if err := req.DecodeBody(maxBytes); err != nil {
+				herr := NewHandlerError(response.StatusUnsupportedMediaType, "")
+				herr.Err = err
+				herr.Headers = headers.NewHeaders()
+				herr.Headers.Set("Accept-Encoding", "gzip, deflate")
+
+				render(w, req, herr)
+				return
+			}
+
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func serveRaw(t *testing.T, h Handler, raw string) (*response.Writer, string) {
+	t.Helper()
+
+	reader := request.NewReader(strings.NewReader(raw))
+	req, err := reader.ReadRequest()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	h(w, req)
+	w.Finish()
+
+	return w, buf.String()
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+
+	h := Chain(okHandler, mark("outer"), mark("inner"))
+	serveRaw(t, h, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, []string{"outer", "inner"}, order)
+
+	// Test: Mux middlewares run after routing
+	order = nil
+	m := NewServeMux()
+	m.Handle("GET", "/users/{id}", func(w *response.Writer, req *request.Request) {
+		order = append(order, req.PathValue("id"))
+		okHandler(w, req)
+	})
+	m.Use(mark("mux"))
+
+	serveMux(t, m, "GET", "/users/42")
+	assert.Equal(t, []string{"mux", "42"}, order)
+}
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	logs := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(logs, nil))
+
+	var seen string
+	h := Chain(func(w *response.Writer, req *request.Request) {
+		seen = RequestIDFromContext(req.Context())
+		body := []byte("hello")
+		w.WriteStatusLine(response.StatusCreated)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, RequestID(), AccessLog(logger))
+
+	// Test: The client's ID is kept and echoed
+	w, out := serveRaw(t, h, "POST /things HTTP/1.1\r\nX-Request-ID: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", seen)
+	assert.Contains(t, out, "x-request-id: abc-123\r\n")
+	assert.Equal(t, response.StatusCreated, w.Status())
+	assert.Equal(t, 5, w.BytesWritten())
+
+	line := logs.String()
+	assert.Contains(t, line, "method=POST")
+	assert.Contains(t, line, "target=/things")
+	assert.Contains(t, line, "status=201")
+	assert.Contains(t, line, "bytes=5")
+	assert.Contains(t, line, "request_id=abc-123")
+
+	// Test: A bogus ID is replaced
+	_, out = serveRaw(t, h, "GET / HTTP/1.1\r\nX-Request-ID: "+strings.Repeat("a", 200)+"\r\n\r\n")
+	assert.Len(t, seen, 32)
+	assert.Contains(t, out, "x-request-id: "+seen+"\r\n")
+}
+
+func TestRecover(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var status response.StatusCode
+	h := Chain(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	}, func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			status = w.Status()
+		}
+	}, Recover(logger, nil))
+
+	w, out := serveRaw(t, h, "GET / HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.Equal(t, response.StatusInternalServerError, status)
+	assert.False(t, w.KeepAlive())
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	cancelled := make(chan struct{})
+	h := Timeout(20*time.Millisecond, nil)(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/fast" {
+			okHandler(w, req)
+			return
+		}
+
+		<-req.Context().Done()
+		close(cancelled)
+		<-release
+
+		_, err := w.WriteBody([]byte("too late"))
+		assert.ErrorIs(t, err, response.ErrResponseDone)
+	})
+
+	// Test: Fast handlers are left alone
+	w, out := serveRaw(t, h, "GET /fast HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Slow handlers get their context cancelled and a 503 is sent
+	w, out = serveRaw(t, h, "GET /slow HTTP/1.1\r\n\r\n")
+	<-cancelled
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.NotContains(t, out, "too late")
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, response.StatusServiceUnavailable, w.Status())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var body []byte
+	var readErr error
+	h := MaxBodySize(5, nil)(func(w *response.Writer, req *request.Request) {
+		body, readErr = io.ReadAll(req.Body)
+		okHandler(w, req)
+	})
+
+	// Test: Bodies within the limit are untouched
+	w, _ := serveRaw(t, h, "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, readErr)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, w.KeepAlive())
+
+	// Test: A Content-Length over the limit is refused before the handler
+	body = nil
+	w, out := serveRaw(t, h, "POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nhello!")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.Nil(t, body)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Chunked bodies are cut off at the limit
+	w, _ = serveRaw(t, h, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nhell\r\n4\r\no wo\r\n0\r\n\r\n")
+	assert.ErrorIs(t, readErr, request.ErrBodyTooLarge)
+	assert.Equal(t, "hello", string(body))
+	assert.False(t, w.KeepAlive())
+}
+
+func TestDecodeBody(t *testing.T) {
+	var body []byte
+	h := DecodeBody(1<<20, nil)(func(w *response.Writer, req *request.Request) {
+		body, _ = io.ReadAll(req.Body)
+		okHandler(w, req)
+	})
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+
+	// Test: Compressed bodies reach the handler decoded
+	_, out := serveRaw(t, h, fmt.Sprintf("POST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", buf.Len(), buf.String()))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Unknown codings get 415 before the handler
+	body = nil
+	_, out = serveRaw(t, h, "POST / HTTP/1.1\r\nContent-Encoding: br\r\nContent-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+	assert.Contains(t, out, "accept-encoding: gzip, deflate\r\n")
+	assert.Nil(t, body)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+// ServeMux dispatches requests to the Handler registered for their method and
+// path. Patterns are made of "/" separated segments where each segment is
+// either a literal, a "{name}" parameter matching exactly one segment, or, as
+// the last segment only, a "{name...}" or "*" wildcard matching the rest of the
+// path. When several patterns match, literals win over parameters and
+// parameters win over wildcards.
+type ServeMux struct {
+	// ErrorRenderer writes the 404 and 405 responses, DefaultErrorRenderer
+	// is used when it is nil.
+	ErrorRenderer ErrorRenderer
+
+	routes      []*route
+	middlewares []Middleware
+}
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern. An empty method matches every method, and GET routes also
+// answer HEAD unless a HEAD route is registered for the pattern. It panics on
+// an invalid pattern or when the same method and pattern are registered twice.
+func (m *ServeMux) Handle(method, pattern string, handler Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, r := range m.routes {
+		if r.method == method && r.pattern == pattern {
+			panic(fmt.Sprintf("server: %s %s is already registered", method, pattern))
+		}
+	}
+
+	m.routes = append(m.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: segments,
+		handler:  handler,
+	})
+}
+
+// Use adds middlewares wrapped around every route's handler, including routes
+// registered before the call. They run once the route is matched, so path
+// parameters are set, but not for the 404 and 405 responses; wrap ServeHTTP
+// with Chain for those.
+func (m *ServeMux) Use(middlewares ...Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+// ServeHTTP is the mux's Handler, pass it to Serve to route every request
+// through the mux.
+func (m *ServeMux) ServeHTTP(w *response.Writer, req *request.Request) {
+	path := req.RequestLine.Path()
+
+	var (
+		best    *route
+		params  map[string]string
+		allowed []string
+	)
+
+	for _, r := range m.routes {
+		captured, ok := r.match(path)
+		if !ok {
+			continue
+		}
+
+		if methodRank(r.method, req.RequestLine.Method) == 0 {
+			allowed = appendMethod(allowed, r.method)
+			if r.method == "GET" {
+				allowed = appendMethod(allowed, "HEAD")
+			}
+			continue
+		}
+
+		if best == nil || r.moreSpecific(best, req.RequestLine.Method) {
+			best = r
+			params = captured
+		}
+	}
+
+	if best == nil {
+		render := m.ErrorRenderer
+		if render == nil {
+			render = DefaultErrorRenderer
+		}
+
+		if len(allowed) > 0 {
+			slices.Sort(allowed)
+
+			herr := NewHandlerError(response.StatusMethodNotAllowed, "")
+			herr.Headers = headers.NewHeaders()
+			herr.Headers.Set("Allow", strings.Join(allowed, ", "))
+
+			render(w, req, herr)
+			return
+		}
+
+		render(w, req, NewHandlerError(response.StatusNotFound, ""))
+		return
+	}
+
+	req.PathParams = params
+	setRoute(req, best.pattern)
+	Chain(best.handler, m.middlewares...)(w, req)
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("server: pattern %q must start with /", pattern)
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+
+	for i, part := range parts {
+		last := i == len(parts)-1
+
+		switch {
+		case part == "*" || (strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}")):
+			if !last {
+				return nil, fmt.Errorf("server: wildcard in pattern %q must be the last segment", pattern)
+			}
+
+			name := "*"
+			if part != "*" {
+				name = part[1 : len(part)-len("...}")]
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: name})
+
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				return nil, fmt.Errorf("server: empty parameter name in pattern %q", pattern)
+			}
+			segments = append(segments, segment{kind: segmentParam, value: name})
+
+		default:
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+
+	return segments, nil
+}
+
+func (r *route) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+
+	parts := strings.Split(path[1:], "/")
+	params := map[string]string{}
+
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			params[seg.value] = unescape(strings.Join(parts[i:], "/"))
+			return params, true
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = unescape(parts[i])
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// moreSpecific reports whether r should win over other when both match the
+// path of a request made with method.
+func (r *route) moreSpecific(other *route, method string) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+
+	// "/a/{x}" and "/a/{x}/{rest...}" both match "/a/b", the one that does not
+	// need the empty wildcard is the better fit
+	if len(r.segments) > len(other.segments) {
+		return r.segments[len(other.segments)].kind != segmentWildcard
+	}
+	if len(r.segments) < len(other.segments) {
+		return other.segments[len(r.segments)].kind == segmentWildcard
+	}
+
+	// a route bound to the request's method beats a GET route answering
+	// HEAD, which beats a catch-all one
+	return methodRank(r.method, method) > methodRank(other.method, method)
+}
+
+// methodRank tells how well a route registered for routeMethod fits a
+// request made with method, zero when it does not.
+func methodRank(routeMethod, method string) int {
+	switch {
+	case routeMethod == method:
+		return 3
+	case routeMethod == "GET" && method == "HEAD":
+		return 2
+	case routeMethod == "":
+		return 1
+	default:
+		return 0
+	}
+}
+
+func appendMethod(methods []string, method string) []string {
+	if slices.Contains(methods, method) {
+		return methods
+	}
+	return append(methods, method)
+}
+
+func unescape(s string) string {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func serveMux(t *testing.T, m *ServeMux, method, target string) string {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	m.ServeHTTP(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func TestServeMux(t *testing.T) {
+	var matched string
+	var params map[string]string
+
+	handle := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			matched = name
+			params = req.PathParams
+			okHandler(w, req)
+		}
+	}
+
+	m := NewServeMux()
+	m.Handle("GET", "/", handle("root"))
+	m.Handle("GET", "/users", handle("users"))
+	m.Handle("POST", "/users", handle("create user"))
+	m.Handle("GET", "/users/me", handle("me"))
+	m.Handle("GET", "/users/{id}", handle("user"))
+	m.Handle("DELETE", "/users/{id}", handle("delete user"))
+	m.Handle("GET", "/static/{path...}", handle("static"))
+	m.Handle("", "/any/*", handle("any"))
+
+	// Test: Literal path, query string is ignored
+	out := serveMux(t, m, "GET", "/users?page=2")
+	assert.Contains(t, out, "200 OK")
+	assert.Equal(t, "users", matched)
+
+	// Test: Method picks the handler
+	serveMux(t, m, "POST", "/users")
+	assert.Equal(t, "create user", matched)
+
+	// Test: Literal wins over parameter
+	serveMux(t, m, "GET", "/users/me")
+	assert.Equal(t, "me", matched)
+
+	// Test: Parameter is captured and unescaped
+	serveMux(t, m, "GET", "/users/jane%20doe")
+	assert.Equal(t, "user", matched)
+	assert.Equal(t, "jane doe", params["id"])
+
+	// Test: Trailing wildcard captures the rest of the path
+	serveMux(t, m, "GET", "/static/css/main.css")
+	assert.Equal(t, "static", matched)
+	assert.Equal(t, "css/main.css", params["path"])
+
+	serveMux(t, m, "PATCH", "/any/thing")
+	assert.Equal(t, "any", matched)
+	assert.Equal(t, "thing", params["*"])
+
+	// Test: Root only matches "/"
+	serveMux(t, m, "GET", "/")
+	assert.Equal(t, "root", matched)
+
+	// Test: Unknown path is a 404
+	matched = ""
+	out = serveMux(t, m, "GET", "/nope")
+	assert.Contains(t, out, "404 Not Found")
+	assert.Equal(t, "", matched)
+
+	// Test: Known path with the wrong method is a 405 listing the allowed ones
+	out = serveMux(t, m, "PUT", "/users/42")
+	assert.Contains(t, out, "405 Method Not Allowed")
+	assert.Contains(t, out, "allow: DELETE, GET, HEAD\r\n")
+	assert.Equal(t, "", matched)
+
+	// Test: GET routes answer HEAD, a HEAD route of its own wins
+	out = serveMux(t, m, "HEAD", "/users/42")
+	assert.Contains(t, out, "200 OK")
+	assert.Equal(t, "user", matched)
+
+	m.Handle("HEAD", "/users/{id}", handle("head user"))
+	serveMux(t, m, "HEAD", "/users/42")
+	assert.Equal(t, "head user", matched)
+
+	// Test: A GET route answering HEAD beats a catch-all route
+	m.Handle("", "/users", handle("any users"))
+	serveMux(t, m, "HEAD", "/users")
+	assert.Equal(t, "users", matched)
+	serveMux(t, m, "OPTIONS", "/users")
+	assert.Equal(t, "any users", matched)
+}
+
+func TestServeMuxInvalidPattern(t *testing.T) {
+	m := NewServeMux()
+
+	assert.Panics(t, func() { m.Handle("GET", "users", okHandler) })
+	assert.Panics(t, func() { m.Handle("GET", "/a/{rest...}/b", okHandler) })
+	assert.Panics(t, func() { m.Handle("GET", "/a/{}", okHandler) })
+
+	m.Handle("GET", "/a", okHandler)
+	assert.Panics(t, func() { m.Handle("GET", "/a", okHandler) })
+}
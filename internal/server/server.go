@@ -2,79 +2,500 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"tcp.scratch.i/internal/response"
 	request "tcp.scratch.i/internal/tests"
 )
 
+// Server serves Handler over HTTP/1.1. Create one with New and drive it with
+// Listen, or hand it connections yourself with Handle. Serve and
+// ServeListener do both in one call.
 type Server struct {
-	closed  bool
+	closed  atomic.Bool
 	handler Handler
+	config  Config
+	logger  *slog.Logger
+
+	// ctx is cancelled once the server stops, it ends background work such
+	// as watching certificates
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	conns    semaphore
+	inflight semaphore
+	stats    stats
+
+	mu        sync.Mutex
+	listener  net.Listener
+	connState map[net.Conn]ConnState
 }
 
-type HandlerError struct {
-	StatusCode response.StatusCode
-	Message    string
+// ConnState is where a connection is in its lifecycle, it is reported to
+// Config.OnConnState and tells Shutdown which connections can be dropped.
+type ConnState int
+
+const (
+	// ConnNew is a connection that has not sent anything yet.
+	ConnNew ConnState = iota
+	// ConnActive is a connection with a request in progress.
+	ConnActive
+	// ConnIdle is a keep-alive connection waiting for its next request.
+	ConnIdle
+	// ConnClosed is a connection that is done.
+	ConnClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case ConnNew:
+		return "new"
+	case ConnActive:
+		return "active"
+	case ConnIdle:
+		return "idle"
+	case ConnClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(c))
 }
 
-type Handler func(w response.Writer, req *request.Request)
+var ErrServerListening = errors.New("server is already listening")
+
+// shutdownPollInterval is how often Shutdown checks whether the active
+// connections are done.
+const shutdownPollInterval = 50 * time.Millisecond
+
+type Handler func(w *response.Writer, req *request.Request)
 
-func runRequest(s *Server, conn io.ReadWriteCloser) {
+// runRequest serves every request the client sends on conn until either side
+// asks for the connection to be closed.
+func runRequest(s *Server, conn net.Conn) {
+	defer s.conns.release()
+	defer s.stats.activeConns.Add(-1)
+	defer s.untrackConn(conn)
 	defer conn.Close()
 
-	req, err := request.RequestFromReader(conn)
+	// whatever goes wrong on this connection must not take the process down
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.logger.Error("panic serving connection", "remote", conn.RemoteAddr(), "panic", recovered, "stack", string(debug.Stack()))
+		}
+	}()
 
-	respWriter := response.NewWriter(conn)
-	if err != nil {
-		respWriter.WriteStatusLine(response.StatusBadRequest)
-		return
+	reader := request.NewReaderWithLimits(conn, s.config.Limits)
+	for first := true; ; first = false {
+		// a new connection gets as long as a request header would to send
+		// its first byte, a kept-alive one waits for its idle timeout
+		waitTimeout := s.config.headerTimeout()
+		if !first {
+			s.trackConn(conn, ConnIdle)
+			waitTimeout = s.config.idleTimeout()
+		}
+
+		conn.SetReadDeadline(deadline(time.Now(), waitTimeout))
+		if err := reader.Wait(); err != nil {
+			return
+		}
+
+		s.trackConn(conn, ConnActive)
+
+		start := time.Now()
+		conn.SetReadDeadline(deadline(start, s.config.headerTimeout()))
+
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.closed.Load() {
+				s.writeParseError(conn, err)
+			}
+			return
+		}
+
+		conn.SetReadDeadline(deadline(start, s.config.ReadTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+
+		respWriter := s.newWriter(conn)
+		respWriter.SetKeepAlive(req.KeepAlive() && !s.closed.Load())
+		respWriter.SetHead(req.RequestLine.Method == "HEAD")
+
+		if !s.inflight.acquire(s.ctx, s.config.QueueTimeout) {
+			s.shedRequest(respWriter, req)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req = req.WithContext(ctx)
+
+		s.stats.inflightRequests.Add(1)
+		s.callHandler(respWriter, req)
+		s.stats.inflightRequests.Add(-1)
+		s.inflight.release()
+		cancel()
+
+		if respWriter.Written() {
+			respWriter.Finish()
+		} else {
+			// the handler returned without answering
+			s.config.ErrorRenderer(respWriter, req, NewHandlerError(response.StatusInternalServerError, ""))
+		}
+
+		if !respWriter.KeepAlive() || s.closed.Load() {
+			return
+		}
+
+		// the next request starts where this body ends, whatever the handler
+		// did not read has to go first
+		if err := req.Body.Close(); err != nil {
+			return
+		}
 	}
+}
+
+// callHandler runs the handler, recovering from panics. A panic before
+// anything was written is answered with a 500, otherwise the response is cut
+// short. Either way the connection is closed afterwards.
+func (s *Server) callHandler(w *response.Writer, req *request.Request) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		stack := debug.Stack()
+		s.logger.Error("panic serving request",
+			"method", req.RequestLine.Method,
+			"target", req.RequestLine.RequestTarget,
+			"panic", recovered,
+			"stack", string(stack),
+		)
+
+		if s.config.OnPanic != nil {
+			s.config.OnPanic(req, recovered, stack)
+		}
+
+		if w.Written() {
+			w.Abort()
+			return
+		}
+
+		w.SetKeepAlive(false)
+		s.config.ErrorRenderer(w, req, NewHandlerError(response.StatusInternalServerError, ""))
+	}()
+
+	s.handler(w, req)
+}
+
+// writeParseError answers a request that could not be parsed, the connection
+// is closed right after since we no longer know where the next request starts.
+func (s *Server) writeParseError(conn net.Conn, err error) {
+	if s.config.Metrics != nil {
+		s.config.Metrics.parseError(err)
+	}
+
+	status := response.StatusBadRequest
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		status = response.StatusRequestTimeout
+		conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		status = response.StatusURITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge), errors.Is(err, request.ErrTooManyHeaders):
+		status = response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		status = response.StatusContentTooLarge
+	}
+
+	respWriter := s.newWriter(conn)
+	respWriter.SetKeepAlive(false)
 
-	s.handler(*respWriter, req)
+	s.config.ErrorRenderer(respWriter, nil, NewHandlerError(status, ""))
+}
+
+// newWriter returns the writer of a response sent on conn.
+func (s *Server) newWriter(conn net.Conn) *response.Writer {
+	w := response.NewWriter(conn)
+	w.SetNameCase(s.config.HeaderCase)
+	return w
 }
 
 func runServer(s *Server, listener net.Listener) {
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if s.closed {
-				return
+	var backoff time.Duration
+
+	for {
+		conn, err := listener.Accept()
+		if s.closed.Load() {
+			if conn != nil {
+				conn.Close()
 			}
+			return
+		}
 
-			if err != nil {
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
 
-			go runRequest(s, conn)
+			// most likely out of file descriptors, give the process some
+			// room instead of spinning
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			s.logger.Error("accept failed", "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			continue
 		}
-	}()
+		backoff = 0
+
+		// waiting here leaves the next connections in the listen backlog
+		if !s.conns.acquire(s.ctx, s.config.QueueTimeout) {
+			go s.shedConn(conn)
+			continue
+		}
+
+		s.stats.activeConns.Add(1)
+		s.trackConn(conn, ConnNew)
+		go runRequest(s, conn)
+	}
 }
 
-func Serve(port uint16, handler Handler) (*Server, error) {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
+// New returns a server for handler that is not listening yet.
+func New(handler Handler, opts ...Option) *Server {
+	config := Config{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	config = config.withDefaults()
+
+	if config.Metrics != nil {
+		handler = config.Metrics.middleware()(handler)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Server{
+		handler:   handler,
+		config:    config,
+		logger:    config.Logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		conns:     newSemaphore(config.MaxConns),
+		inflight:  newSemaphore(config.MaxInflight),
+		connState: make(map[net.Conn]ConnState),
+	}
+}
+
+// Serve listens on all interfaces on port and serves handler in the
+// background. Options are applied after the port, so WithAddr overrides it.
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
+	opts = append([]Option{WithAddr(fmt.Sprintf(":%d", port))}, opts...)
+
+	server := New(handler, opts...)
+	if err := server.Listen(); err != nil {
 		return nil, err
 	}
 
-	server := &Server{
-		closed:  false,
-		handler: handler,
+	return server, nil
+}
+
+// ServeListener serves handler on connections accepted from ln in the
+// background. The listener is owned by the server from then on, it is closed
+// by Close and Shutdown. This is the entry point for tests and for sockets
+// passed in by a supervisor.
+func ServeListener(ln net.Listener, handler Handler, opts ...Option) (*Server, error) {
+	server := New(handler, opts...)
+	if err := server.serveListener(ln); err != nil {
+		return nil, err
 	}
-	go runServer(server, ln)
 
-	return server, err
+	return server, nil
 }
 
-func (s *Server) Close() error {
-	s.closed = true
+// Listen binds the configured Network and Addr and starts accepting
+// connections in the background.
+func (s *Server) Listen() error {
+	ln, err := net.Listen(s.config.Network, s.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	if err := s.serveListener(ln); err != nil {
+		ln.Close()
+		return err
+	}
+
 	return nil
 }
 
-func (s *Server) Listen() {
+func (s *Server) serveListener(ln net.Listener) error {
+	if s.config.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.config.TLSConfig)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return ErrServerListening
+	}
+	s.listener = ln
+
+	go runServer(s, ln)
+
+	return nil
 }
 
+// Handle serves every request sent on conn and returns once the connection
+// is done, conn is closed by then. It counts against MaxConns like accepted
+// connections do. It is the way to drive the server with
+// connections that do not come from a net.Listener. When the server has a
+// TLSConfig the handshake is done on conn first.
 func (s *Server) Handle(conn net.Conn) {
+	if s.closed.Load() {
+		conn.Close()
+		return
+	}
+
+	if _, ok := conn.(*tls.Conn); !ok && s.config.TLSConfig != nil {
+		conn = tls.Server(conn, s.config.TLSConfig)
+	}
+
+	if !s.conns.acquire(s.ctx, s.config.QueueTimeout) {
+		s.shedConn(conn)
+		return
+	}
+
+	s.stats.activeConns.Add(1)
+	s.trackConn(conn, ConnNew)
+	runRequest(s, conn)
+}
+
+// Addr returns the address the server is listening on, nil when it is not
+// listening.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Server) trackConn(conn net.Conn, state ConnState) {
+	s.mu.Lock()
+	prev, known := s.connState[conn]
+	s.connState[conn] = state
+	s.mu.Unlock()
+
+	if s.config.Metrics != nil {
+		s.config.Metrics.connStateChanged(prev, known, state)
+	}
+
+	if s.config.OnConnState != nil {
+		s.config.OnConnState(conn, state)
+	}
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	prev, known := s.connState[conn]
+	delete(s.connState, conn)
+	s.mu.Unlock()
+
+	if s.config.Metrics != nil {
+		s.config.Metrics.connStateChanged(prev, known, ConnClosed)
+	}
+
+	if s.config.OnConnState != nil {
+		s.config.OnConnState(conn, ConnClosed)
+	}
+}
+
+// closeIdleConns closes every connection that is waiting for a request and
+// reports whether no connections are left at all.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, state := range s.connState {
+		// the connection's goroutine untracks it once it notices
+		if state == ConnIdle || state == ConnNew {
+			conn.Close()
+		}
+	}
+
+	return len(s.connState) == 0
+}
+
+func (s *Server) closeListener() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the listener and closes every connection right away, cutting
+// off requests that are still being served. Use Shutdown to let them finish.
+func (s *Server) Close() error {
+	s.closed.Store(true)
+	s.cancel()
+	err := s.closeListener()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.connState {
+		conn.Close()
+	}
+
+	return err
+}
+
+// Shutdown stops accepting new connections, closes the idle keep-alive ones
+// and waits for the active ones to finish their current request. If ctx
+// expires first the remaining connections are left alone and ctx's error is
+// returned, Close can then be used to drop them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	s.cancel()
+	err := s.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
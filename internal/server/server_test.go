@@ -0,0 +1,390 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/headers"
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func okHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(*response.GetDefaultHeaders(0))
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+
+	// Test: Idle keep-alive connections are closed right away
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	_, err = idle.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	idleReader := bufio.NewReader(idle)
+	statusLine, err := idleReader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, statusLine, "200")
+
+	// Test: Active requests are waited for
+	active, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+
+	_, err = active.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(idleReader)
+	assert.NoError(t, err)
+
+	close(release)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	statusLine, err = bufio.NewReader(active).ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, statusLine, "200")
+}
+
+func TestHandlerWithoutResponse(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, statusLine, "500")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	panics := make(chan any, 2)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/late" {
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(*response.GetDefaultHeaders(100))
+			w.WriteBody([]byte("partial"))
+		}
+		panic("boom")
+	}, WithOnPanic(func(req *request.Request, recovered any, stack []byte) {
+		assert.NotEmpty(t, stack)
+		panics <- recovered
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(target string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// Test: Panic before writing is answered with a 500 and the connection closed
+	out := get("/early")
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.Equal(t, "boom", <-panics)
+
+	// Test: Panic after writing cuts the response short
+	out = get("/late")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "partial"))
+	assert.Equal(t, "boom", <-panics)
+}
+
+func TestTimeouts(t *testing.T) {
+	s, err := Serve(0, okHandler, WithConfig(Config{
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Slow headers get a 408
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: local"))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"))
+
+	// Test: Idle keep-alive connection is closed without a response
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	// the deadline only keeps a broken server from hanging the test, reading
+	// to EOF is what shows the connection was closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(string(out), "HTTP/1.1"))
+}
+
+func TestServeListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	states := make(chan ConnState, 8)
+	s, err := ServeListener(ln, okHandler, WithOnConnState(func(conn net.Conn, state ConnState) {
+		states <- state
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.Equal(t, ln.Addr(), s.Addr())
+	assert.ErrorIs(t, s.Listen(), ErrServerListening)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+
+	assert.Equal(t, ConnNew, <-states)
+	assert.Equal(t, ConnActive, <-states)
+	assert.Equal(t, ConnClosed, <-states)
+}
+
+func TestHandle(t *testing.T) {
+	s := New(okHandler, WithLimits(request.Limits{MaxRequestLineBytes: 16}))
+	assert.Nil(t, s.Addr())
+
+	// Test: Handle serves a connection that did not come from a listener
+	client, conn := net.Pipe()
+	go s.Handle(conn)
+
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Limits from the options are applied
+	client, conn = net.Pipe()
+	go s.Handle(conn)
+
+	go client.Write([]byte("GET /a/rather/long/path HTTP/1.1\r\n\r\n"))
+	out, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 414 URI Too Long\r\n"))
+}
+
+func TestLoadShedding(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		okHandler(w, req)
+	}, WithMaxConns(2), WithMaxInflight(1), WithQueueTimeout(50*time.Millisecond, 3*time.Second))
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		return conn
+	}
+
+	busy := send()
+	defer busy.Close()
+	<-started
+
+	// Test: Requests over MaxInflight are shed once the queue timeout passes
+	conn := send()
+	defer conn.Close()
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, string(out), "retry-after: 3\r\n")
+
+	// Test: Connections over MaxConns are shed before being read
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	conn = send()
+	defer conn.Close()
+
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 503 Service Unavailable\r\n"))
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.ShedRequests)
+	assert.Equal(t, uint64(1), stats.ShedConns)
+	assert.Equal(t, int64(1), stats.InflightRequests)
+
+	close(release)
+
+	line, err := bufio.NewReader(busy).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+}
+
+func TestHeaderCase(t *testing.T) {
+	s, err := Serve(0, okHandler, WithAddr("127.0.0.1:0"), WithHeaderCase(headers.CaseCanonical))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "\r\nContent-Length: ")
+	assert.Contains(t, string(out), "\r\nConnection: close\r\n")
+	assert.NotContains(t, string(out), "content-length")
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s, err := ServeListener(ln, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A body the parser can not frame is never read as the next request
+	for _, framing := range []string{
+		"Content-Length: abc\r\n",
+		"Content-Length: -5\r\n",
+		"Content-Length: 5\r\nContent-Length: 27\r\n",
+		"Content-Length: 27\r\nTransfer-Encoding: chunked\r\n",
+		"Transfer-Encoding : chunked\r\n\r\n1b\r\n",
+	} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\n" + framing + "\r\nGET /smuggled HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+
+		out, _ := io.ReadAll(conn)
+		conn.Close()
+
+		assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 400 Bad Request\r\n"), framing)
+		assert.Equal(t, 1, strings.Count(string(out), "HTTP/1.1 "), framing)
+	}
+}
+
+func TestMaxBodySizeOnCopiedRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// RequestID hands a copy of the request on, the server drains the body of
+	// its own
+	s, err := ServeListener(ln, Chain(okHandler, RequestID(), MaxBodySize(4, nil)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: An unread body over the limit is not drained, the connection is closed
+	body := strings.Repeat("a", 100)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n64\r\n" + body + "\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(string(out), "HTTP/1.1 "))
+}
+
+func TestRepeatedHeaderLines(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s, err := ServeListener(ln, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: One name repeated over more lines than the limit gets 431
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n" + strings.Repeat("X: a\r\n", 5000) + "\r\n"))
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 431 Request Header Fields Too Large\r\n", line)
+}
+
+func TestLimitsDefaults(t *testing.T) {
+	// Test: A partial Limits keeps the default of every other limit
+	s := New(okHandler, WithLimits(request.Limits{MaxBodyBytes: 1 << 20}))
+	assert.Equal(t, request.DefaultLimits.MaxRequestLineBytes, s.config.Limits.MaxRequestLineBytes)
+	assert.Equal(t, request.DefaultLimits.MaxHeaderBytes, s.config.Limits.MaxHeaderBytes)
+	assert.Equal(t, request.DefaultLimits.MaxHeaderCount, s.config.Limits.MaxHeaderCount)
+	assert.Equal(t, int64(1<<20), s.config.Limits.MaxBodyBytes)
+}
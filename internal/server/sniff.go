@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"mime"
+	"path"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file detectContentType looks at.
+const sniffLen = 512
+
+// extensionTypes is looked up before mime.TypeByExtension, whose table
+// depends on the mime.types files installed on the host.
+var extensionTypes = map[string]string{
+	".css":   "text/css; charset=utf-8",
+	".gif":   "image/gif",
+	".htm":   "text/html; charset=utf-8",
+	".html":  "text/html; charset=utf-8",
+	".ico":   "image/x-icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".mjs":   "text/javascript; charset=utf-8",
+	".mp4":   "video/mp4",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".txt":   "text/plain; charset=utf-8",
+	".wasm":  "application/wasm",
+	".webm":  "video/webm",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".xml":   "text/xml; charset=utf-8",
+}
+
+// signature matches a file format by the bytes it starts with, a zero byte
+// in mask skips the byte at that position.
+type signature struct {
+	prefix      []byte
+	mask        []byte
+	contentType string
+}
+
+var signatures = []signature{
+	{prefix: []byte("%PDF-"), contentType: "application/pdf"},
+	{prefix: []byte("\x89PNG\r\n\x1a\n"), contentType: "image/png"},
+	{prefix: []byte("\xff\xd8\xff"), contentType: "image/jpeg"},
+	{prefix: []byte("GIF87a"), contentType: "image/gif"},
+	{prefix: []byte("GIF89a"), contentType: "image/gif"},
+	{prefix: []byte("RIFF\x00\x00\x00\x00WEBP"), mask: []byte("\xff\xff\xff\xff\x00\x00\x00\x00\xff\xff\xff\xff"), contentType: "image/webp"},
+	{prefix: []byte("\x00\x00\x00\x00ftyp"), mask: []byte("\x00\x00\x00\x00\xff\xff\xff\xff"), contentType: "video/mp4"},
+	{prefix: []byte("\x1a\x45\xdf\xa3"), contentType: "video/webm"},
+	{prefix: []byte("\x00asm"), contentType: "application/wasm"},
+	{prefix: []byte("\x1f\x8b\x08"), contentType: "application/x-gzip"},
+	{prefix: []byte("PK\x03\x04"), contentType: "application/zip"},
+	{prefix: []byte("wOFF"), contentType: "font/woff"},
+	{prefix: []byte("wOF2"), contentType: "font/woff2"},
+}
+
+// contentTypeFor picks the Content-Type of a file from its extension, falling
+// back on sniffing its first bytes.
+func contentTypeFor(name string, head []byte) string {
+	ext := path.Ext(name)
+	if ct, ok := extensionTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return detectContentType(head)
+}
+
+// detectContentType guesses the Content-Type of data from its first bytes. It
+// knows the common binary formats, html and xml; anything else is plain text
+// when it is valid UTF-8 without control characters, and opaque bytes
+// otherwise.
+func detectContentType(data []byte) string {
+	data = data[:min(len(data), sniffLen)]
+
+	for _, sig := range signatures {
+		if sig.match(data) {
+			return sig.contentType
+		}
+	}
+
+	text := bytes.TrimLeft(data, " \t\r\n")
+	if len(text) > 0 && text[0] == '<' {
+		lower := bytes.ToLower(text[:min(len(text), 16)])
+		switch {
+		case bytes.HasPrefix(lower, []byte("<!doctype html")), bytes.HasPrefix(lower, []byte("<html")):
+			return "text/html; charset=utf-8"
+		case bytes.HasPrefix(lower, []byte("<?xml")):
+			return "text/xml; charset=utf-8"
+		}
+	}
+
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func (sig signature) match(data []byte) bool {
+	if len(data) < len(sig.prefix) {
+		return false
+	}
+
+	for i, b := range sig.prefix {
+		if sig.mask != nil && sig.mask[i] == 0 {
+			continue
+		}
+		if data[i] != b {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isText(data []byte) bool {
+	// the sniffed window may cut the last rune in half
+	for i := 1; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+
+	if !utf8.Valid(data) {
+		return false
+	}
+
+	for _, b := range data {
+		if b < ' ' && b != '\t' && b != '\n' && b != '\r' && b != '\f' {
+			return false
+		}
+	}
+
+	return true
+}
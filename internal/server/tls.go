@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certWatchInterval is how often ServeTLS checks the certificate files for
+// changes.
+const certWatchInterval = 10 * time.Second
+
+var ErrNoCertificates = errors.New("no certificates loaded")
+
+// KeyPair names the PEM files of a certificate chain and its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds the certificates a TLS server presents and picks one per
+// handshake from the server name the client asked for (SNI). The files can be
+// reloaded while serving, handshakes in progress keep the certificate they
+// started with and established connections are not touched.
+type CertStore struct {
+	pairs []KeyPair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// NewCertStore loads every pair. The first one is the default, it is served
+// to clients that send no server name or one no certificate covers.
+func NewCertStore(pairs ...KeyPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	c := &CertStore{pairs: pairs}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the certificate files again. When any of them fails to load
+// the certificates in use are kept and the error is returned.
+func (c *CertStore) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(c.pairs))
+	byName := map[string]*tls.Certificate{}
+	modTimes := map[string]time.Time{}
+
+	for _, pair := range c.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("server: loading %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+
+		// the first certificate to claim a name gets it
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(file); err == nil {
+				modTimes[file] = info.ModTime()
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.certs = certs
+	c.byName = byName
+	c.modTimes = modTimes
+
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate. It looks for an
+// exact match of the server name first, then for a wildcard certificate
+// covering it, and falls back on the default certificate.
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := c.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	if len(c.certs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	return c.certs[0], nil
+}
+
+// TLSConfig returns a server configuration that serves the store's
+// certificates.
+func (c *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// changed reports whether any certificate file was modified since it was
+// last loaded.
+func (c *CertStore) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, pair := range c.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				// half way through being replaced, look again next time
+				continue
+			}
+			if !info.ModTime().Equal(c.modTimes[file]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Watch reloads the certificates whenever the process receives SIGHUP or,
+// every interval, when one of the files changed on disk. It blocks until ctx
+// is done. Failed reloads are passed to onError when it is not nil, the
+// previous certificates stay in use.
+func (c *CertStore) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+		}
+
+		if err := c.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// ServeTLS is Serve over TLS with the certificates from certs, which are
+// reloaded on SIGHUP or when their files change for as long as the server
+// runs. A TLSConfig given in the options is used as the base configuration,
+// its certificates are replaced by the store's.
+func ServeTLS(port uint16, handler Handler, certs *CertStore, opts ...Option) (*Server, error) {
+	// applied last so WithConfig, which replaces the whole Config, can not
+	// leave the server without an address or a TLS configuration
+	opts = append(opts, func(c *Config) {
+		if c.Addr == "" {
+			c.Addr = fmt.Sprintf(":%d", port)
+		}
+		if c.TLSConfig == nil {
+			c.TLSConfig = certs.TLSConfig()
+		}
+	})
+
+	server := New(handler, opts...)
+	server.config.TLSConfig.Certificates = nil
+	server.config.TLSConfig.GetCertificate = certs.GetCertificate
+
+	if err := server.Listen(); err != nil {
+		return nil, err
+	}
+
+	go certs.Watch(server.ctx, certWatchInterval, func(err error) {
+		server.logger.Error("reloading certificates failed", "error", err)
+	})
+
+	return server, nil
+}
+
+// GenerateSelfSigned creates a self-signed certificate valid for a year for
+// hosts, which may be DNS names or IP addresses, and returns the certificate
+// and its private key PEM encoded. It is meant for local development only,
+// clients have to be told to trust it.
+func GenerateSelfSigned(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"tcp.scratch.i development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// WriteSelfSigned generates a self-signed certificate for hosts and writes it
+// to the files of pair, the key is only readable by its owner.
+func WriteSelfSigned(pair KeyPair, hosts ...string) error {
+	certPEM, keyPEM, err := GenerateSelfSigned(hosts...)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(pair.KeyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(pair.CertFile, certPEM, 0o644)
+}
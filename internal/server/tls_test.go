@@ -0,0 +1,153 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp.scratch.i/internal/response"
+	request "tcp.scratch.i/internal/tests"
+)
+
+func writeCert(t *testing.T, dir, name string, pool *x509.CertPool) KeyPair {
+	pair := KeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, WriteSelfSigned(pair, name, "127.0.0.1"))
+
+	certPEM, err := os.ReadFile(pair.CertFile)
+	require.NoError(t, err)
+	require.True(t, pool.AppendCertsFromPEM(certPEM))
+
+	return pair
+}
+
+func tlsGet(t *testing.T, addr string, config *tls.Config) (string, tls.ConnectionState) {
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	return string(out), conn.ConnectionState()
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	pool := x509.NewCertPool()
+	a := writeCert(t, dir, "a.test", pool)
+	writeCert(t, dir, "b.test", pool)
+
+	certs, err := NewCertStore(a, KeyPair{
+		CertFile: filepath.Join(dir, "b.test.crt"),
+		KeyFile:  filepath.Join(dir, "b.test.key"),
+	})
+	require.NoError(t, err)
+
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		if req.TLS == nil {
+			panic("no TLS state on the request")
+		}
+		okHandler(w, req)
+	}, certs, WithAddr("127.0.0.1:0"))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The certificate is picked by SNI and http/1.1 is negotiated
+	out, state := tlsGet(t, s.Addr().String(), &tls.Config{
+		ServerName: "b.test",
+		RootCAs:    pool,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, []string{"b.test"}, state.PeerCertificates[0].DNSNames)
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+
+	// Test: Unknown names get the first certificate
+	_, state = tlsGet(t, s.Addr().String(), &tls.Config{ServerName: "c.test", InsecureSkipVerify: true})
+	assert.Equal(t, []string{"a.test"}, state.PeerCertificates[0].DNSNames)
+	serial := state.PeerCertificates[0].SerialNumber
+
+	// Test: Reload picks up the new files, a broken file keeps the old ones
+	require.NoError(t, WriteSelfSigned(a, "a.test"))
+	require.NoError(t, certs.Reload())
+
+	_, state = tlsGet(t, s.Addr().String(), &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	assert.NotEqual(t, serial, state.PeerCertificates[0].SerialNumber)
+	serial = state.PeerCertificates[0].SerialNumber
+
+	require.NoError(t, os.WriteFile(a.CertFile, []byte("garbage"), 0o644))
+	assert.Error(t, certs.Reload())
+
+	_, state = tlsGet(t, s.Addr().String(), &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	assert.Equal(t, serial, state.PeerCertificates[0].SerialNumber)
+}
+
+func TestServeTLSWithConfig(t *testing.T) {
+	dir := t.TempDir()
+	pool := x509.NewCertPool()
+	a := writeCert(t, dir, "a.test", pool)
+
+	certs, err := NewCertStore(a)
+	require.NoError(t, err)
+
+	// Test: A whole Config without a TLSConfig still serves the store's certificates
+	s, err := ServeTLS(0, okHandler, certs, WithConfig(Config{Addr: "127.0.0.1:0"}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	out, state := tlsGet(t, s.Addr().String(), &tls.Config{ServerName: "a.test", RootCAs: pool})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, []string{"a.test"}, state.PeerCertificates[0].DNSNames)
+}
+
+func TestServeTLSClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	serverPool := x509.NewCertPool()
+	clientPool := x509.NewCertPool()
+
+	certs, err := NewCertStore(writeCert(t, dir, "server.test", serverPool))
+	require.NoError(t, err)
+
+	client := writeCert(t, dir, "client.test", clientPool)
+	clientCert, err := tls.LoadX509KeyPair(client.CertFile, client.KeyFile)
+	require.NoError(t, err)
+
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.TLS.VerifiedChains[0][0].DNSNames[0])
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, certs, WithAddr("127.0.0.1:0"), WithClientCAs(clientPool))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The verified client chain is exposed on the request
+	out, _ := tlsGet(t, s.Addr().String(), &tls.Config{
+		ServerName:   "server.test",
+		RootCAs:      serverPool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nclient.test"))
+
+	// Test: Clients without a certificate are turned away
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "server.test", RootCAs: serverPool})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	_, err = io.ReadAll(conn)
+	assert.Error(t, err)
+}
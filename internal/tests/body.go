@@ -0,0 +1,284 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// NoBody is the Body of requests that do not carry one.
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// newBody picks the body reader matching the framing announced in the
+// request's headers.
+func (rr *Reader) newBody(r *Request) io.ReadCloser {
+	if r.state != StateBody {
+		return NoBody
+	}
+
+	// chunked was already validated while parsing the headers
+	if chunked, _ := r.chunked(); chunked {
+		return &chunkedBody{
+			reader:  rr,
+			request: r,
+			state:   StateChunkSize,
+		}
+	}
+
+	return &body{
+		reader:    rr,
+		request:   r,
+		remaining: r.contentLen,
+	}
+}
+
+// LimitBody caps the body of r at n bytes, reading past them fails with
+// ErrBodyTooLarge and calls onExceed, which may be nil. The limit is set on
+// the body read off the connection, which every copy of r shares whatever it
+// did to Body, so the rest of the body is not drained past n bytes either.
+func (r *Request) LimitBody(n int64, onExceed func()) {
+	if r.body == nil {
+		r.Body = MaxBytesReader(r.Body, n, onExceed)
+		return
+	}
+
+	r.body.limit = n
+	r.body.onExceed = onExceed
+}
+
+// body reads a body delimited by Content-Length.
+type body struct {
+	reader    *Reader
+	request   *Request
+	remaining int64
+	err       error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.reader.read(p)
+	b.remaining -= int64(n)
+
+	if b.remaining == 0 {
+		b.request.state = StateDone
+		return n, nil
+	}
+
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+		b.request.state = StateError
+	}
+
+	return n, err
+}
+
+// Close discards the rest of the body so the connection is ready for the next
+// request.
+func (b *body) Close() error {
+	_, err := io.Copy(io.Discard, b)
+	return err
+}
+
+// chunkedBody decodes a body sent with the chunked transfer coding, see RFC
+// 9112 section 7.1. The trailer section is parsed into Request.Trailers once
+// the last chunk has been read.
+type chunkedBody struct {
+	reader    *Reader
+	request   *Request
+	state     ParserState
+	remaining int
+	total     int64
+	err       error
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for {
+		switch b.state {
+		case StateError:
+			return 0, b.err
+
+		case StateDone:
+			return 0, io.EOF
+
+		case StateChunkSize:
+			line, err := b.reader.line()
+			if err != nil {
+				return 0, b.fail(orIfBufferFull(err, ErrMalformedChunk))
+			}
+
+			size, n, err := parseChunkSize(line)
+			if err != nil {
+				return 0, b.fail(err)
+			}
+			b.reader.discard(n)
+
+			b.total += int64(size)
+			if maxBody := b.request.limits.MaxBodyBytes; maxBody > 0 && b.total > maxBody {
+				return 0, b.fail(ErrBodyTooLarge)
+			}
+
+			if size == 0 {
+				b.state = StateTrailers
+			} else {
+				b.remaining = size
+				b.state = StateChunkData
+			}
+
+		case StateChunkData:
+			if len(p) == 0 {
+				return 0, nil
+			}
+
+			n, err := b.reader.read(p[:min(len(p), b.remaining)])
+			b.remaining -= n
+
+			if b.remaining == 0 {
+				b.state = StateChunkDataDone
+			}
+
+			if err != nil && b.remaining > 0 {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, b.fail(err)
+			}
+
+			return n, nil
+
+		case StateChunkDataDone:
+			line, err := b.reader.line()
+			if err != nil {
+				return 0, b.fail(orIfBufferFull(err, ErrMalformedChunk))
+			}
+
+			if len(line) != len(SEPERATOR) {
+				return 0, b.fail(ErrMalformedChunk)
+			}
+			b.reader.discard(len(SEPERATOR))
+
+			b.state = StateChunkSize
+
+		case StateTrailers:
+			n, done, err := b.request.Trailers.Parse(b.reader.buf[:b.reader.bufLen])
+			if err != nil {
+				return 0, b.fail(err)
+			}
+			b.reader.discard(n)
+
+			if done {
+				b.state = StateDone
+				b.request.state = StateDone
+				return 0, io.EOF
+			}
+
+			if err := b.reader.fill(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, b.fail(orIfBufferFull(err, ErrHeadersTooLarge))
+			}
+		}
+	}
+}
+
+// orIfBufferFull replaces the internal full buffer error with one that says
+// which part of the body did not fit.
+func orIfBufferFull(err, replacement error) error {
+	if errors.Is(err, errBufferFull) {
+		return replacement
+	}
+	return err
+}
+
+func (b *chunkedBody) fail(err error) error {
+	b.state = StateError
+	b.request.state = StateError
+	b.err = err
+	return err
+}
+
+// Close discards the rest of the body so the connection is ready for the next
+// request.
+func (b *chunkedBody) Close() error {
+	_, err := io.Copy(io.Discard, b)
+	return err
+}
+
+// MaxBytesReader limits r to n bytes, reading past them fails with
+// ErrBodyTooLarge and calls onExceed, which may be nil. Close drains what is
+// left up to the limit before closing r, so a body longer than n is never read
+// to its end.
+func MaxBytesReader(r io.ReadCloser, n int64, onExceed func()) io.ReadCloser {
+	return &maxBytesReader{r: r, limit: n, onExceed: onExceed}
+}
+
+type maxBytesReader struct {
+	r io.ReadCloser
+
+	// limit is NoLimit until one is set, read counts the bytes read so far
+	limit    int64
+	read     int64
+	onExceed func()
+	err      error
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	if l.limit < 0 {
+		n, err := l.r.Read(p)
+		l.read += int64(n)
+		return n, err
+	}
+
+	remaining := max(l.limit-l.read, 0)
+
+	// read one byte past the limit to tell a body of exactly n bytes from a
+	// longer one
+	if int64(len(p)) > remaining+1 {
+		p = p[:remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) <= remaining {
+		l.read += int64(n)
+		l.err = err
+		return n, err
+	}
+
+	n = int(remaining)
+	l.read += int64(n)
+	l.err = ErrBodyTooLarge
+	if l.onExceed != nil {
+		l.onExceed()
+	}
+
+	return n, l.err
+}
+
+func (l *maxBytesReader) Close() error {
+	if _, err := io.Copy(io.Discard, l); err != nil {
+		return err
+	}
+	return l.r.Close()
+}
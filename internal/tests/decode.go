@@ -0,0 +1,112 @@
+package request
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrUnsupportedContentEncoding = errors.New("unsupported content-encoding")
+
+// DecodeBody swaps Body for a reader undoing the request's Content-Encoding,
+// so handlers read the body as it was before the client compressed it. gzip
+// (or x-gzip) and deflate are supported, several codings are undone in the
+// reverse order of the one they are listed in, and identity is skipped. Any
+// other coding fails with ErrUnsupportedContentEncoding, leaving the request
+// untouched.
+//
+// maxBytes caps the decoded body, reading past it fails with ErrBodyTooLarge
+// so a small compressed body can not expand without bound. Zero means no
+// limit. Content-Encoding and Content-Length are removed from the headers
+// since they describe the body as sent.
+func (r *Request) DecodeBody(maxBytes int64) error {
+	value, ok := r.Headers.Get("Content-Encoding")
+	if !ok {
+		return nil
+	}
+
+	var codings []string
+	for _, coding := range strings.Split(value, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, coding)
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, coding)
+		}
+	}
+
+	r.Headers.Delete("Content-Encoding")
+	if len(codings) == 0 {
+		return nil
+	}
+	r.Headers.Delete("Content-Length")
+
+	var body io.Reader = r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		body = &decoder{src: body, coding: codings[i]}
+	}
+
+	if maxBytes > 0 {
+		body = MaxBytesReader(io.NopCloser(body), maxBytes, nil)
+	}
+
+	r.Body = decodedBody{Reader: body, Closer: r.Body}
+	return nil
+}
+
+// decoder undoes one content coding. The decompressor is only set up on the
+// first Read, it reads the stream header and would block on a body the
+// handler never asked for.
+type decoder struct {
+	src    io.Reader
+	coding string
+	r      io.Reader
+	err    error
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.open()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return d.r.Read(p)
+}
+
+func (d *decoder) open() (io.Reader, error) {
+	if d.coding != "deflate" {
+		return gzip.NewReader(d.src)
+	}
+
+	// deflate is meant to be the zlib format but some clients send a raw
+	// deflate stream, the zlib header tells them apart
+	br := bufio.NewReader(d.src)
+	header, err := br.Peek(2)
+	if err != nil && len(header) < 2 {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decodedBody reads the decoded body and closes the body as sent, there is
+// no need to decompress what is left of it.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
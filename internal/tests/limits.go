@@ -0,0 +1,57 @@
+package request
+
+// NoLimit turns a limit off where a zero field would get the default, see
+// Limits.WithDefaults.
+const NoLimit = -1
+
+// Limits bounds how much of a request a Reader accepts. A zero or negative
+// field means no limit, use WithDefaults to fill the zero ones first.
+type Limits struct {
+	// MaxRequestLineBytes caps the request line, CRLF excluded.
+	MaxRequestLineBytes int
+
+	// MaxHeaderBytes caps the header section, field lines and their CRLFs
+	// included. It also caps the trailer section of chunked bodies.
+	MaxHeaderBytes int
+
+	// MaxHeaderCount caps the number of header field lines, a name sent on
+	// several lines counts once per line.
+	MaxHeaderCount int
+
+	// MaxBodyBytes caps the body as sent on the wire, framing excluded.
+	MaxBodyBytes int64
+}
+
+// DefaultLimits are the limits NewReader uses.
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      64 << 10,
+	MaxHeaderCount:      100,
+}
+
+// WithDefaults returns l with its zero fields set to those of DefaultLimits.
+// Fields set to NoLimit stay off.
+func (l Limits) WithDefaults() Limits {
+	if l.MaxRequestLineBytes == 0 {
+		l.MaxRequestLineBytes = DefaultLimits.MaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = DefaultLimits.MaxBodyBytes
+	}
+	return l
+}
+
+// maxBuffer is how far the read buffer may grow, everything that has to sit
+// in it at once is bounded by the request line and header limits.
+func (l Limits) maxBuffer() int {
+	if l.MaxRequestLineBytes <= 0 || l.MaxHeaderBytes <= 0 {
+		return 0
+	}
+	return l.MaxRequestLineBytes + l.MaxHeaderBytes + len(SEPERATOR)
+}
@@ -3,9 +3,12 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"strconv"
+	"strings"
 
 	"tcp.scratch.i/internal/headers"
 )
@@ -18,34 +21,65 @@ const (
 	StateBody        ParserState = "body"
 	StateHeader      ParserState = "headers"
 	StateError       ParserState = "error"
+
+	// states of a chunked body, see RFC 9112 section 7.1
+	StateChunkSize     ParserState = "chunk-size"
+	StateChunkData     ParserState = "chunk-data"
+	StateChunkDataDone ParserState = "chunk-data-done"
+	StateTrailers      ParserState = "trailers"
 )
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     *headers.Headers
-	Body        string
-	state       ParserState
-}
 
-func getInt(headers *headers.Headers, name string, defaultValue int) int {
-	valueStr, exits := headers.Get(name)
-	if !exits {
-		return defaultValue
-	}
+	// Body streams the request body straight off the connection. It is never
+	// nil, requests without a body get NoBody.
+	Body io.ReadCloser
 
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return defaultValue
-	}
+	// Trailers holds the trailer fields sent after a chunked body.
+	Trailers *headers.Headers
 
-	return value
+	// PathParams holds the values captured by the route pattern that matched
+	// this request, keyed by parameter name.
+	PathParams map[string]string
+
+	// Pattern is the route pattern that matched this request, "" until a
+	// router matched one.
+	Pattern string
+
+	// RemoteAddr is the network address of the client, set by the server.
+	RemoteAddr string
+
+	// TLS describes the connection the request came in on, it is nil for
+	// cleartext connections. With mutual TLS the client's verified chains are
+	// in TLS.VerifiedChains.
+	TLS *tls.ConnectionState
+
+	ctx         context.Context
+	state       ParserState
+	limits      Limits
+	headerBytes int
+	headerLines int
+
+	// contentLen is the validated Content-Length the body is framed with,
+	// -1 when there is none
+	contentLen int64
+
+	// body is the body read off the connection, shared with the copies of
+	// the request, nil for requests that were not read by a Reader
+	body *maxBytesReader
 }
 
-func newRequest() *Request {
+func newRequest(limits Limits) *Request {
 	return &Request{
-		state:   StateInitialized,
-		Headers: headers.NewHeaders(),
-		Body:    "",
+		state:    StateInitialized,
+		limits:   limits,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		Body:     NoBody,
+
+		contentLen: -1,
 	}
 }
 
@@ -70,10 +104,21 @@ dance:
 				return 0, err
 			}
 
+			maxLine := r.limits.MaxRequestLineBytes
 			if rl == nil && n == 0 {
+				// the CRLF would have fit by now
+				if maxLine > 0 && len(currentData) >= maxLine+len(SEPERATOR) {
+					r.state = StateError
+					return 0, ErrRequestLineTooLong
+				}
 				break dance
 			}
 
+			if maxLine > 0 && n-len(SEPERATOR) > maxLine {
+				r.state = StateError
+				return 0, ErrRequestLineTooLong
+			}
+
 			r.RequestLine = *rl
 			read += n
 
@@ -85,6 +130,17 @@ dance:
 				return 0, err
 			}
 
+			r.headerBytes += n
+			r.headerLines += bytes.Count(currentData[:n], SEPERATOR)
+			if done {
+				// the empty line ending the section is not a field line
+				r.headerLines--
+			}
+			if err := r.checkHeaderLimits(len(currentData)-n, done); err != nil {
+				r.state = StateError
+				return 0, err
+			}
+
 			if n == 0 {
 				break dance
 			}
@@ -92,43 +148,207 @@ dance:
 			read += n
 
 			if done {
-				if r.hasBody() {
+				chunked, err := r.chunked()
+				if err != nil {
+					r.state = StateError
+					return 0, err
+				}
+
+				r.contentLen, err = r.parseContentLength()
+				if err != nil {
+					r.state = StateError
+					return 0, err
+				}
+
+				// a request framed both ways is how bodies get smuggled past
+				// a proxy that picks the other framing, see RFC 9112
+				// section 6.3
+				if chunked && r.contentLen != -1 {
+					r.state = StateError
+					return 0, ErrAmbiguousFraming
+				}
+
+				if chunked || r.hasBody() {
 					r.state = StateBody
 				} else {
 					r.state = StateDone
 				}
 			}
 
-		case StateBody:
-			contentLen := getInt(r.Headers, "Content-Length", 0)
+		case StateBody, StateDone:
+			break dance
+		}
+	}
+
+	return read, nil
+}
+
+// checkHeaderLimits is called after every step of header parsing, pending is
+// what is left of a field line that is not complete yet.
+func (r *Request) checkHeaderLimits(pending int, done bool) error {
+	if maxBytes := r.limits.MaxHeaderBytes; maxBytes > 0 {
+		if done {
+			pending = 0
+		}
 
-			if contentLen == 0 {
-				panic("chunked not implemented")
+		if r.headerBytes+pending > maxBytes {
+			return ErrHeadersTooLarge
+		}
+	}
+
+	if maxCount := r.limits.MaxHeaderCount; maxCount > 0 && r.headerLines > maxCount {
+		return ErrTooManyHeaders
+	}
+
+	return nil
+}
+
+// chunked reports whether the body uses the chunked transfer coding. Chunked
+// has to be the last coding applied, any other Transfer-Encoding leaves us
+// with no way to find the end of the body.
+func (r *Request) chunked() (bool, error) {
+	te, ok := r.Headers.Get("Transfer-Encoding")
+	if !ok {
+		return false, nil
+	}
+
+	codings := strings.Split(te, ",")
+	if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+		return false, ErrUnsupportedTransferEncoding
+	}
+
+	return true, nil
+}
+
+// parseChunkSize parses a "chunk-size [ chunk-ext ] CRLF" line and returns the
+// size along with the number of bytes consumed, 0 when the line is incomplete.
+func parseChunkSize(b []byte) (int, int, error) {
+	idx := bytes.Index(b, SEPERATOR)
+	if idx == -1 {
+		return 0, 0, nil
+	}
+
+	line := b[:idx]
+	if ext := bytes.IndexByte(line, ';'); ext != -1 {
+		line = line[:ext]
+	}
+	line = bytes.TrimRight(line, " \t")
+
+	// ParseInt would also take a sign, the grammar only allows hex digits
+	if len(line) == 0 || line[0] == '+' || line[0] == '-' {
+		return 0, 0, ErrMalformedChunk
+	}
+
+	size, err := strconv.ParseInt(string(line), 16, 32)
+	if err != nil {
+		return 0, 0, ErrMalformedChunk
+	}
+
+	return int(size), idx + len(SEPERATOR), nil
+}
+
+func (r *Request) hasBody() bool {
+	return r.contentLen > 0
+}
+
+// parseContentLength reads the Content-Length header, -1 when there is none.
+// Only digits are accepted, and a value repeated over several lines or in a
+// list has to be the same every time. Anything else fails with
+// ErrInvalidContentLength: guessing would let the body be read as the next
+// request.
+func (r *Request) parseContentLength() (int64, error) {
+	n := int64(-1)
+
+	for _, line := range r.Headers.Values("Content-Length") {
+		for _, value := range strings.Split(line, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" || strings.Trim(value, "0123456789") != "" {
+				return 0, ErrInvalidContentLength
 			}
 
-			remainingLen := min(contentLen-len(r.Body), len(currentData))
-			r.Body += string(currentData[:remainingLen])
-			read += remainingLen
+			m, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, ErrInvalidContentLength
+			}
 
-			if len(r.Body) == contentLen {
-				r.state = StateDone
+			if n != -1 && m != n {
+				return 0, ErrInvalidContentLength
 			}
+			n = m
+		}
+	}
 
-		case StateDone:
-			break dance
+	return n, nil
+}
+
+// ContentLength returns the body length announced in the Content-Length
+// header, -1 when the request has none or its body is chunked.
+func (r *Request) ContentLength() int64 {
+	if chunked, _ := r.chunked(); chunked {
+		return -1
+	}
+
+	n, err := r.parseContentLength()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// KeepAlive reports whether the client is willing to send further requests on
+// the same connection. HTTP/1.1 connections are persistent unless the client
+// lists "close" in its Connection header.
+func (r *Request) KeepAlive() bool {
+	connection, ok := r.Headers.Get("Connection")
+	if !ok {
+		return true
+	}
+
+	for _, token := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "close") {
+			return false
 		}
 	}
 
-	return read, nil
+	return true
 }
 
-func (r *Request) hasBody() bool {
-	contentLen := getInt(r.Headers, "Content-Length", 0)
-	return contentLen > 0
+// PathValue returns the value captured for the named segment of the matched
+// route pattern, or "" when there is none.
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
+}
+
+// Context returns the request's context, the server cancels it once the
+// handler returns. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// BodyBytes reads the whole body into memory. It is meant for small bodies,
+// the body is swapped for an in-memory copy so it can be read again.
+func (r *Request) BodyBytes() ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
 }
 
-func (r *Request) done() bool {
-	return r.state == StateDone || r.state == StateError
+func (r *Request) headersDone() bool {
+	return r.state == StateBody || r.state == StateDone
 }
 
 type RequestLine struct {
@@ -141,11 +361,36 @@ func (r *RequestLine) ValidHTTP() bool {
 	return r.HTTPVersion == "1.1"
 }
 
+// Path returns the request target without its query string.
+func (r *RequestLine) Path() string {
+	path, _, _ := strings.Cut(r.RequestTarget, "?")
+	return path
+}
+
+// Query returns the raw query string of the request target, without the "?".
+func (r *RequestLine) Query() string {
+	_, query, _ := strings.Cut(r.RequestTarget, "?")
+	return query
+}
+
 var (
 	ErrBadStartLine           = errors.New("malformend request-line")
 	ErrIncompleteStartLine    = errors.New("incomplete startline")
 	ErrUnsupportedHTTPVersion = errors.New("unsupported http version ! only http/1.1 is supported as of now")
 	ErrRequestInErrorState    = errors.New("Request in error state")
+
+	ErrMalformedChunk              = errors.New("malformed chunk")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer-encoding ! chunked must be the final coding")
+	ErrInvalidContentLength        = errors.New("invalid content-length")
+	ErrAmbiguousFraming            = errors.New("both content-length and transfer-encoding are set")
+
+	// errors for requests going over the Reader's Limits
+	ErrRequestLineTooLong = errors.New("request-line too long")
+	ErrHeadersTooLarge    = errors.New("header section too large")
+	ErrTooManyHeaders     = errors.New("too many header fields")
+	ErrBodyTooLarge       = errors.New("request body too large")
+
+	errBufferFull = errors.New("read buffer is full")
 )
 
 var SEPERATOR = []byte("\r\n")
@@ -182,34 +427,182 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	return requestLine, restOfMsg, nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := newRequest()
+// Reader reads consecutive requests off a single connection. Bytes read past
+// the end of one request are kept around and used for the next one, so
+// pipelined or back-to-back requests on a keep-alive connection are not lost.
+type Reader struct {
+	reader io.Reader
+	limits Limits
+
+	// buf starts small and grows as needed, up to what the limits allow
+	buf    []byte
+	bufLen int
+
+	// body of the last request, it has to be consumed before the next
+	// request can be parsed
+	body io.ReadCloser
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		limits: limits,
+		buf:    make([]byte, 1024),
+	}
+}
 
-	// NOTE: this buffer can overrun easysily so we need to take care of this
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !request.done() {
-		n, err := reader.Read(buf[bufLen:])
+// ReadRequest parses the request line and headers of the next request and
+// returns as soon as they are complete, the body is left on the connection
+// and read through Request.Body. Whatever is left of the previous request's
+// body is discarded first. It returns io.EOF when the peer closed the
+// connection cleanly between two requests.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.body != nil {
+		err := rr.body.Close()
+		rr.body = nil
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	request := newRequest(rr.limits)
 
-		bufLen += n
-		readN, pErr := request.parse(buf[:bufLen])
+	for {
+		readN, pErr := request.parse(rr.buf[:rr.bufLen])
 		if pErr != nil {
 			return nil, pErr
 		}
+		rr.discard(readN)
 
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+		if request.headersDone() {
+			break
+		}
 
-		if err == io.EOF {
-			if request.state != StateDone {
+		if err := rr.fill(); err != nil {
+			if err == io.EOF {
+				if request.state == StateInitialized && rr.bufLen == 0 {
+					return nil, io.EOF
+				}
 				return nil, io.ErrUnexpectedEOF
 			}
-			break
+			return nil, err
 		}
+	}
+
+	maxBody := rr.limits.MaxBodyBytes
+	if maxBody > 0 && request.contentLen > maxBody {
+		return nil, ErrBodyTooLarge
+	}
+
+	request.body = &maxBytesReader{r: rr.newBody(request), limit: NoLimit}
+	request.Body = request.body
+	rr.body = request.Body
+
+	return request, nil
+}
+
+// Wait blocks until the first byte of the next request is buffered, which
+// tells an idle connection apart from one with a request in progress.
+func (rr *Reader) Wait() error {
+	for rr.bufLen == 0 {
+		if err := rr.fill(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Buffered returns the number of bytes already read from the underlying
+// reader that belong to the next request.
+func (rr *Reader) Buffered() int {
+	return rr.bufLen
+}
+
+// fill reads whatever the underlying reader has to offer into the buffer,
+// growing it first when it is full.
+func (rr *Reader) fill() error {
+	if rr.bufLen == len(rr.buf) {
+		if err := rr.grow(); err != nil {
+			return err
+		}
+	}
+
+	n, err := rr.reader.Read(rr.buf[rr.bufLen:])
+	rr.bufLen += n
+
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+func (rr *Reader) grow() error {
+	size := 2 * len(rr.buf)
+
+	if maxSize := rr.limits.maxBuffer(); maxSize > 0 {
+		if len(rr.buf) >= maxSize {
+			return errBufferFull
+		}
+		size = min(size, maxSize)
+	}
+
+	buf := make([]byte, size)
+	copy(buf, rr.buf[:rr.bufLen])
+	rr.buf = buf
+
+	return nil
+}
+
+// discard drops the first n buffered bytes.
+func (rr *Reader) discard(n int) {
+	copy(rr.buf, rr.buf[n:rr.bufLen])
+	rr.bufLen -= n
+}
+
+// read hands out buffered bytes first and only then goes to the underlying
+// reader, so large bodies are not copied through the buffer.
+func (rr *Reader) read(p []byte) (int, error) {
+	if rr.bufLen > 0 {
+		n := copy(p, rr.buf[:rr.bufLen])
+		rr.discard(n)
+		return n, nil
+	}
+
+	return rr.reader.Read(p)
+}
+
+// line returns the buffered bytes up to and including the next CRLF without
+// consuming them, filling the buffer as needed.
+func (rr *Reader) line() ([]byte, error) {
+	for {
+		if idx := bytes.Index(rr.buf[:rr.bufLen], SEPERATOR); idx != -1 {
+			return rr.buf[:idx+len(SEPERATOR)], nil
+		}
+
+		if err := rr.fill(); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// RequestFromReader reads a single request, body included, into memory.
+// Framing errors in the body are reported here rather than on read.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	request, err := NewReader(reader).ReadRequest()
+	if err != nil {
+		return nil, err
+	}
 
+	if _, err := request.BodyBytes(); err != nil {
+		return nil, err
 	}
 
 	return request, nil
@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -93,7 +99,9 @@ func TestParseBody(t *testing.T) {
 
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	body, err := r.BodyBytes()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -108,3 +116,391 @@ func TestParseBody(t *testing.T) {
 
 	require.Error(t, err)
 }
+
+func TestReadRequestKeepAlive(t *testing.T) {
+	// Test: Two requests in a single read are both parsed
+	reader := NewReader(strings.NewReader(
+		"POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Connection: close\r\n" +
+			"\r\n",
+	))
+
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	body, err := r.BodyBytes()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, r.KeepAlive())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.False(t, r.KeepAlive())
+
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Requests split across small reads
+	reader = NewReader(&chunkReader{
+		data: "GET /a HTTP/1.1\r\nHost: localhost:42069\r\n\r\n" +
+			"GET /b HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Connection closed in the middle of a request
+	reader = NewReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: local"))
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestParseChunkedBody(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"6\r\n" +
+			"hello \r\n" +
+			"7;name=value\r\n" +
+			"world!\n\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	body, err := r.BodyBytes()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	checksum, ok := r.Trailers.Get("X-Checksum")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", checksum)
+
+	// Test: Empty chunked body without trailers
+	r, err = RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+	))
+	require.NoError(t, err)
+
+	body, err = r.BodyBytes()
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: Invalid chunk size
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\n" +
+			"hello\r\n",
+	))
+	assert.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunk data longer than its size
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"hello\r\n" +
+			"0\r\n\r\n",
+	))
+	assert.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunked is not the final coding
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked, gzip\r\n" +
+			"\r\n",
+	))
+	assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Connection closed before the last chunk
+	_, err = RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n",
+	))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadRequestStreamsBody(t *testing.T) {
+	// Test: Request is returned before the body has been sent
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n"))
+		pw.Write([]byte("5\r\nhello\r\n"))
+		pw.Write([]byte("6\r\n world\r\n0\r\n\r\n"))
+		pw.Close()
+	}()
+
+	r, err := NewReader(pr).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+
+	buf := make([]byte, 5)
+	n, err := io.ReadFull(r.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	rest, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, " world", string(rest))
+
+	// Test: Unread body is skipped before the next request
+	reader := NewReader(&chunkReader{
+		data: "POST /a HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world" +
+			"POST /b HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+			"GET /c HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+
+	for _, target := range []string{"/a", "/b", "/c"} {
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, target, r.RequestLine.RequestTarget)
+	}
+
+	// Test: Request without a body reads as empty
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	// Test: Headers larger than the initial buffer
+	longValue := strings.Repeat("a", 4000)
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET /" + longValue + " HTTP/1.1\r\nHost: localhost:42069\r\nX-Long: " + longValue + "\r\n\r\n",
+		numBytesPerRead: 512,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/"+longValue, r.RequestLine.RequestTarget)
+
+	xLong, _ := r.Headers.Get("X-Long")
+	assert.Equal(t, longValue, xLong)
+
+	limits := Limits{
+		MaxRequestLineBytes: 64,
+		MaxHeaderBytes:      128,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        8,
+	}
+
+	// Test: Request line over the limit, with and without its CRLF
+	_, err = NewReaderWithLimits(strings.NewReader("GET /"+longValue+" HTTP/1.1\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	_, err = NewReaderWithLimits(&chunkReader{data: "GET /" + longValue, numBytesPerRead: 16}, limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section over the limit
+	_, err = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nX-Long: "+longValue+"\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Too many header fields
+	_, err = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+
+	// Test: Content-Length over the limit is rejected before reading the body
+	_, err = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n"), limits).ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the limit
+	r, err = NewReaderWithLimits(strings.NewReader(
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+	), limits).ReadRequest()
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := strings.Repeat(`{"hello":"world"}`, 100)
+
+	compress := func(coding string, data []byte) []byte {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		switch coding {
+		case "gzip":
+			w = gzip.NewWriter(buf)
+		case "deflate":
+			w = zlib.NewWriter(buf)
+		default:
+			w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	read := func(contentEncoding string, body []byte) *Request {
+		raw := "POST / HTTP/1.1\r\nContent-Encoding: " + contentEncoding + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+		r, err := NewReader(strings.NewReader(raw)).ReadRequest()
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: gzip, zlib and raw deflate bodies are decoded
+	for _, tc := range []struct{ header, coding string }{{"gzip", "gzip"}, {"x-gzip", "gzip"}, {"deflate", "deflate"}, {"deflate", "raw"}} {
+		r := read(tc.header, compress(tc.coding, []byte(payload)))
+		require.NoError(t, r.DecodeBody(0))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err, tc.header)
+		assert.Equal(t, payload, string(body), tc.header)
+
+		_, ok := r.Headers.Get("Content-Encoding")
+		assert.False(t, ok)
+		assert.Equal(t, int64(-1), r.ContentLength())
+	}
+
+	// Test: Stacked codings are undone last first
+	r := read("deflate, gzip", compress("gzip", compress("deflate", []byte(payload))))
+	require.NoError(t, r.DecodeBody(0))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(body))
+
+	// Test: The decoded size is capped
+	r = read("gzip", compress("gzip", make([]byte, 1<<20)))
+	require.NoError(t, r.DecodeBody(1000))
+	body, err = io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Len(t, body, 1000)
+
+	// Test: Unknown codings are refused
+	r = read("br", []byte("whatever"))
+	assert.ErrorIs(t, r.DecodeBody(0), ErrUnsupportedContentEncoding)
+	_, ok := r.Headers.Get("Content-Encoding")
+	assert.True(t, ok)
+
+	// Test: A corrupt body fails on read
+	r = read("gzip", []byte("not gzip at all"))
+	require.NoError(t, r.DecodeBody(0))
+	_, err = io.ReadAll(r.Body)
+	assert.Error(t, err)
+}
+
+func TestReadRequestRepeatedHeaders(t *testing.T) {
+	// Test: Field lines are counted, not distinct names
+	var sb strings.Builder
+	sb.WriteString("GET / HTTP/1.1\r\n")
+	for range 5000 {
+		sb.WriteString("X: a\r\n")
+	}
+	sb.WriteString("\r\n")
+
+	_, err := NewReader(&chunkReader{data: sb.String(), numBytesPerRead: 8}).ReadRequest()
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+
+	// Test: A section of exactly the limit is accepted
+	sb.Reset()
+	sb.WriteString("GET / HTTP/1.1\r\n")
+	for range DefaultLimits.MaxHeaderCount {
+		sb.WriteString("X: a\r\n")
+	}
+	sb.WriteString("\r\n")
+
+	r, err := NewReader(&chunkReader{data: sb.String(), numBytesPerRead: 8}).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.Headers.Len())
+	assert.Len(t, r.Headers.Values("x"), DefaultLimits.MaxHeaderCount)
+}
+
+func TestReadRequestContentLength(t *testing.T) {
+	read := func(headers string) (*Request, error) {
+		return NewReader(strings.NewReader("POST / HTTP/1.1\r\n" + headers + "\r\nhello")).ReadRequest()
+	}
+
+	// Test: Repeated identical values are one value
+	for _, headers := range []string{"Content-Length: 5\r\nContent-Length: 5\r\n", "Content-Length: 5, 5\r\n"} {
+		r, err := read(headers)
+		require.NoError(t, err, headers)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, int64(5), r.ContentLength())
+	}
+
+	// Test: Anything but digits, or differing values, is refused rather than
+	// read as no body
+	for _, headers := range []string{
+		"Content-Length: abc\r\n",
+		"Content-Length: -5\r\n",
+		"Content-Length: +5\r\n",
+		"Content-Length: \r\n",
+		"Content-Length: 5\r\nContent-Length: 6\r\n",
+		"Content-Length: 5,\r\n",
+		"Content-Length: 99999999999999999999\r\n",
+	} {
+		_, err := read(headers)
+		assert.ErrorIs(t, err, ErrInvalidContentLength, headers)
+	}
+
+	// Test: Both framings at once
+	_, err := read("Content-Length: 5\r\nTransfer-Encoding: chunked\r\n")
+	assert.ErrorIs(t, err, ErrAmbiguousFraming)
+}
+
+func TestLimitsWithDefaults(t *testing.T) {
+	// Test: Setting one limit keeps the defaults of the others
+	limits := Limits{MaxBodyBytes: 1 << 20}.WithDefaults()
+	assert.Equal(t, Limits{
+		MaxRequestLineBytes: DefaultLimits.MaxRequestLineBytes,
+		MaxHeaderBytes:      DefaultLimits.MaxHeaderBytes,
+		MaxHeaderCount:      DefaultLimits.MaxHeaderCount,
+		MaxBodyBytes:        1 << 20,
+	}, limits)
+	assert.Positive(t, limits.maxBuffer())
+
+	// Test: NoLimit turns a limit off
+	limits = Limits{MaxHeaderCount: NoLimit}.WithDefaults()
+	assert.Equal(t, NoLimit, limits.MaxHeaderCount)
+
+	var sb strings.Builder
+	sb.WriteString("GET / HTTP/1.1\r\n")
+	for i := range 200 {
+		fmt.Fprintf(&sb, "X-%d: v\r\n", i)
+	}
+	sb.WriteString("\r\n")
+
+	r, err := NewReaderWithLimits(strings.NewReader(sb.String()), limits).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, 200, r.Headers.Len())
+}